@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Both AdmissionReview versions share the same schema, so requests are
+// handled as v1beta1 internally and converted at the edges.
+var (
+	admissionV1      = admissionv1.SchemeGroupVersion.String()
+	admissionV1beta1 = v1beta1.SchemeGroupVersion.String()
+)
+
+// decodeReview parses an AdmissionReview of any supported version and
+// returns it together with the apiVersion the caller used.
+func decodeReview(body []byte) (*v1beta1.AdmissionReview, string, error) {
+	tm := metav1.TypeMeta{}
+	if err := json.Unmarshal(body, &tm); err != nil {
+		return nil, "", err
+	}
+
+	switch tm.APIVersion {
+	case admissionV1:
+		review := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, &review); err != nil {
+			return nil, tm.APIVersion, err
+		}
+		ar := &v1beta1.AdmissionReview{}
+		if review.Request != nil {
+			ar.Request = requestFromV1(review.Request)
+		}
+		return ar, tm.APIVersion, nil
+	case admissionV1beta1, "":
+		// API servers older than 1.16 may omit the TypeMeta entirely.
+		ar := &v1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, ar); err != nil {
+			return nil, admissionV1beta1, err
+		}
+		return ar, admissionV1beta1, nil
+	default:
+		return nil, tm.APIVersion, fmt.Errorf("unsupported AdmissionReview apiVersion %q", tm.APIVersion)
+	}
+}
+
+// admissionResponse is the AdmissionResponse plus the warnings field added
+// in Kubernetes 1.19, which the vendored API types predate. v1 and v1beta1
+// responses share the same schema, so it is used for both.
+type admissionResponse struct {
+	v1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+
+	// rules and violations are the policy rules that applied to the request
+	// and the ones it broke, optOuts the security defaults it declined, all
+	// recorded in the audit log.
+	rules      []string
+	violations []violation
+	optOuts    []securityOptOut
+}
+
+type admissionReviewResponse struct {
+	metav1.TypeMeta
+	Response *admissionResponse `json:"response,omitempty"`
+}
+
+// encodeReview wraps resp in an AdmissionReview of the given apiVersion.
+func encodeReview(apiVersion string, resp *admissionResponse) ([]byte, error) {
+	return json.Marshal(admissionReviewResponse{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: "AdmissionReview"},
+		Response: resp,
+	})
+}
+
+func requestFromV1(req *admissionv1.AdmissionRequest) *v1beta1.AdmissionRequest {
+	return &v1beta1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          v1beta1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
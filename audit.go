@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// auditSchema versions the audit record format. Fields may be added within
+// a version, but never renamed, removed or changed in meaning.
+const auditSchema = "k8s-ac.audit/v1"
+
+// auditRecord is the single record written for every admission decision.
+type auditRecord struct {
+	Schema         string           `json:"schema"`
+	Time           time.Time        `json:"time"`
+	UID            string           `json:"uid"`
+	Endpoint       string           `json:"endpoint"`
+	Kind           string           `json:"kind"`
+	Namespace      string           `json:"namespace"`
+	Name           string           `json:"name"`
+	Operation      string           `json:"operation"`
+	User           string           `json:"user"`
+	Groups         []string         `json:"groups"`
+	PolicyRevision string           `json:"policyRevision"`
+	MatchedRules   []string         `json:"matchedRules"`
+	Violations     []violation      `json:"violations"`
+	OptOuts        []securityOptOut `json:"securityDefaultsOptOuts,omitempty"`
+	Decision       string           `json:"decision"`
+	Message        string           `json:"message,omitempty"`
+	Warnings       []string         `json:"warnings,omitempty"`
+	Patch          json.RawMessage  `json:"patch,omitempty"`
+	LatencyMs      float64          `json:"latencyMs"`
+}
+
+// newAuditRecord describes the decision resp for req. req and resp are nil
+// when the review could not be decoded.
+func newAuditRecord(endpoint, revision string, req *v1beta1.AdmissionRequest, resp *admissionResponse, start time.Time) *auditRecord {
+	rec := &auditRecord{
+		Schema:         auditSchema,
+		Time:           start.UTC(),
+		Endpoint:       endpoint,
+		PolicyRevision: revision,
+		MatchedRules:   []string{},
+		Violations:     []violation{},
+		Groups:         []string{},
+		Decision:       responseOutcome(resp),
+		LatencyMs:      float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if req != nil {
+		rec.UID = string(req.UID)
+		rec.Kind = req.Kind.Kind
+		rec.Namespace = req.Namespace
+		rec.Name = req.Name
+		rec.Operation = string(req.Operation)
+		rec.User = req.UserInfo.Username
+		if req.UserInfo.Groups != nil {
+			rec.Groups = req.UserInfo.Groups
+		}
+	}
+	if resp != nil {
+		if resp.rules != nil {
+			rec.MatchedRules = resp.rules
+		}
+		if resp.violations != nil {
+			rec.Violations = resp.violations
+		}
+		rec.OptOuts = resp.optOuts
+		if resp.Result != nil {
+			rec.Message = resp.Result.Message
+		}
+		rec.Warnings = resp.Warnings
+		rec.Patch = resp.Patch
+	}
+	return rec
+}
+
+// auditLog writes audit records as JSON lines.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// newAuditLog opens the audit sink: "stdout", or the path of a file rotated
+// once it exceeds maxSize bytes. Rotated files older than maxAge are removed.
+func newAuditLog(sink string, maxSize int64, maxAge time.Duration) (*auditLog, error) {
+	if sink == "stdout" {
+		return &auditLog{out: nopCloser{os.Stdout}}, nil
+	}
+	f, err := openRotatingFile(sink, maxSize, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: f}, nil
+}
+
+// write appends rec to the log. A nil log discards records.
+func (a *auditLog) write(rec *auditRecord) error {
+	if a == nil {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.out.Write(append(data, '\n'))
+	return err
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.out.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile is a file that is renamed to path.<timestamp> and recreated
+// once a write would take it past maxSize. It is not safe for concurrent use.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	file *os.File
+	size int64
+}
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.removeExpired()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	renameErr := os.Rename(r.path, rotated)
+	// keep writing to the current file if it could not be moved aside
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.removeExpired()
+	return nil
+}
+
+// removeExpired deletes rotated files older than maxAge.
+func (r *rotatingFile) removeExpired() {
+	if r.maxAge <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-r.maxAge)
+	for _, m := range matches {
+		t, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(m, r.path+"."))
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(m); err != nil {
+			log.Error("can't remove expired audit log", "file", m, "error", err)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
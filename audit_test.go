@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	expired := path + "." + time.Now().Add(-48*time.Hour).UTC().Format(rotatedTimeFormat)
+	if err := ioutil.WriteFile(expired, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(path, 10, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired file %s was not removed", expired)
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "third\n" {
+		t.Errorf("current file = %q, want %q", current, "third\n")
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, name := range rotated {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	if got := strings.Join(contents, ""); got != "first\nsecond\n" {
+		t.Errorf("rotated files contain %q, want %q", got, "first\nsecond\n")
+	}
+}
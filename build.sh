@@ -5,25 +5,24 @@ set -o nounset
 set -o pipefail
 
 read -p "Write DockerHub repo: " tag
+image=$tag/k8s-ac:1.0.0
 
 
 echo " ==================================== "
 echo -e "\e[32mCreate Docker Image\e[0m"
 echo " ==================================== "
-docker build --no-cache -t $tag/k8s-ac:1.0.0 .
+docker build --no-cache -t $image .
 
 echo " ==================================== "
 echo -e "\e[32mCreate Secret for AC\e[0m"
 echo " ==================================== "
-bash scripts/webhook-create-signed-cert.sh  --service k8s-ac-svc  --secret k8s-ac
+export CA_BUNDLE=$(docker run --rm -u "$(id -u)" -v "$PWD:/out" $image \
+    certs generate -service k8s-ac-svc -namespace default -secret k8s-ac -secretFile /out/secret.yaml)
+kubectl apply -f secret.yaml
 
 echo " ==================================== "
 echo -e "\e[32mDeploy AC to K8S\e[0m"
 echo " ==================================== "
-export CA_BUNDLE=$(kubectl config view --raw -o json|jq -r '.clusters[0].cluster."certificate-authority"'|xargs cat|base64|tr -d '\n')
-cat k8s-valid-temp.yaml|envsubst>validation.yaml
-cat k8s-mut-temp.yaml|envsubst>mutation.yaml
-kubectl apply -f validation.yaml
-kubectl apply -f k8s-deployment.yaml
-kubectl apply -f k8s-svc.yaml
-kubectl apply -f mutation.yaml
+docker run --rm -u "$(id -u)" -v "$PWD:/out" $image \
+    manifests -policyFile /out/policy.yaml -image $image -caBundle "$CA_BUNDLE" -o /out/k8s-ac.yaml
+kubectl apply -f k8s-ac.yaml
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// keyPair is a PEM encoded certificate and its private key.
+type keyPair struct {
+	certPEM, keyPEM []byte
+	cert            *x509.Certificate
+	key             crypto.Signer
+}
+
+// runCerts implements the "certs" subcommand.
+func runCerts(args []string) int {
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, "usage: k8s-ac certs generate [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("certs generate", flag.ExitOnError)
+	service := fs.String("service", "k8s-ac-svc", "Service name of the webhook.")
+	namespace := fs.String("namespace", "default", "Namespace of the webhook service and secret.")
+	secret := fs.String("secret", "k8s-ac", "Name of the Secret holding the serving key pair.")
+	extraSANs := fs.String("extraSANs", "", "Comma separated additional DNS names or IPs for the serving certificate.")
+	validity := fs.Duration("validity", 365*24*time.Hour, "Validity of the serving certificate.")
+	caValidity := fs.Duration("caValidity", 10*365*24*time.Hour, "Validity of the CA certificate.")
+	outDir := fs.String("outDir", "", "Directory to write ca.pem, cert.pem and key.pem to.")
+	secretFile := fs.String("secretFile", "", "File to write a Secret manifest with the key pair to.")
+	fs.Parse(args[1:])
+	if *outDir == "" && *secretFile == "" {
+		// the key pair would be thrown away, leaving a caBundle nothing serves
+		fmt.Fprintln(os.Stderr, "usage: k8s-ac certs generate [flags]")
+		fmt.Fprintln(os.Stderr, "-outDir or -secretFile is required")
+		return 2
+	}
+
+	ca, err := newCA(fmt.Sprintf("%s.%s CA", *service, *namespace), *caValidity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create CA: %v\n", err)
+		return 1
+	}
+	hosts := serviceHosts(*service, *namespace)
+	if *extraSANs != "" {
+		hosts = append(hosts, strings.Split(*extraSANs, ",")...)
+	}
+	serving, err := newServingCert(ca, fmt.Sprintf("%s.%s.svc", *service, *namespace), hosts, *validity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create serving certificate: %v\n", err)
+		return 1
+	}
+
+	if *outDir != "" {
+		if err := writeKeyPairFiles(*outDir, ca, serving); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write certificates: %v\n", err)
+			return 1
+		}
+	}
+	if *secretFile != "" {
+		manifest, err := secretManifest(*secret, *namespace, ca, serving)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not encode secret: %v\n", err)
+			return 1
+		}
+		if err := ioutil.WriteFile(*secretFile, manifest, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write secret: %v\n", err)
+			return 1
+		}
+	}
+
+	// print the caBundle for the webhook configurations
+	fmt.Println(base64.StdEncoding.EncodeToString(ca.certPEM))
+	return 0
+}
+
+// serviceHosts returns the DNS names the API server may use for service.
+func serviceHosts(service, namespace string) []string {
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+func newCA(commonName string, validity time.Duration) (*keyPair, error) {
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return newKeyPair(tmpl, nil, validity)
+}
+
+func newServingCert(ca *keyPair, commonName string, hosts []string, validity time.Duration) (*keyPair, error) {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return newKeyPair(tmpl, ca, validity)
+}
+
+// newKeyPair signs tmpl with parent, or self-signs it when parent is nil.
+func newKeyPair(tmpl *x509.Certificate, parent *keyPair, validity time.Duration) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = now.Add(-5 * time.Minute)
+	tmpl.NotAfter = now.Add(validity)
+
+	signerCert, signerKey := tmpl, crypto.Signer(key)
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, key.Public(), signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		cert:    cert,
+		key:     key,
+	}, nil
+}
+
+func writeKeyPairFiles(dir string, ca, serving *keyPair) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.certPEM, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), serving.certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "key.pem"), serving.keyPEM, 0600)
+}
+
+// secretManifest renders the Secret mounted by the Deployment that the
+// manifests subcommand generates.
+func secretManifest(name, namespace string, ca, serving *keyPair) ([]byte, error) {
+	secret := v1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"name": "k8s-ac"},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"ca.pem":   ca.certPEM,
+			"cert.pem": serving.certPEM,
+			"key.pem":  serving.keyPEM,
+		},
+	}
+	return yaml.Marshal(secret)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestRunCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outDir, secretFile := filepath.Join(dir, "out"), filepath.Join(dir, "secret.yaml")
+
+	// runCerts prints the caBundle on stdout
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = stdout
+	code := runCerts([]string{"generate", "-service", "hook", "-namespace", "infra", "-secret", "hook-tls",
+		"-extraSANs", "10.0.0.1", "-outDir", outDir, "-secretFile", secretFile})
+	os.Stdout = saved
+	stdout.Close()
+	if code != 0 {
+		t.Fatalf("runCerts exited with %d", code)
+	}
+
+	read := func(path string) []byte {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	caPEM, certPEM, keyPEM := read(filepath.Join(outDir, "ca.pem")), read(filepath.Join(outDir, "cert.pem")), read(filepath.Join(outDir, "key.pem"))
+
+	bundle, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(read(stdout.Name()))))
+	if err != nil {
+		t.Fatalf("caBundle is not base64: %v", err)
+	}
+	if !bytes.Equal(bundle, caPEM) {
+		t.Errorf("caBundle does not match ca.pem")
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("cert.pem and key.pem do not form a key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("no certificate in ca.pem")
+	}
+	for _, name := range []string{"hook", "hook.infra", "hook.infra.svc", "hook.infra.svc.cluster.local", "10.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("serving certificate does not verify for %s: %v", name, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "other.infra.svc", Roots: roots}); err == nil {
+		t.Errorf("serving certificate verifies for other.infra.svc")
+	}
+
+	secret := v1.Secret{}
+	if err := yaml.Unmarshal(read(secretFile), &secret); err != nil {
+		t.Fatalf("invalid secret manifest: %v", err)
+	}
+	if secret.Kind != "Secret" || secret.Name != "hook-tls" || secret.Namespace != "infra" {
+		t.Errorf("secret is %s %s/%s, want Secret infra/hook-tls", secret.Kind, secret.Namespace, secret.Name)
+	}
+	for name, want := range map[string][]byte{"ca.pem": caPEM, "cert.pem": certPEM, "key.pem": keyPEM} {
+		if !bytes.Equal(secret.Data[name], want) {
+			t.Errorf("secret %s does not match the file written", name)
+		}
+	}
+}
+
+func TestRunCertsWithoutOutput(t *testing.T) {
+	stdout, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	savedOut, savedErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	code := runCerts([]string{"generate", "-service", "hook"})
+	os.Stdout, os.Stderr = savedOut, savedErr
+	if code != 2 {
+		t.Errorf("runCerts without -outDir and -secretFile exited with %d, want 2", code)
+	}
+	if fi, err := stdout.Stat(); err != nil || fi.Size() != 0 {
+		t.Errorf("runCerts printed a caBundle without writing the key pair")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// clientAuth verifies that callers of the webhook present a certificate
+// signed by a trusted CA and, when an allowlist is set, that the certificate
+// names an allowed client.
+type clientAuth struct {
+	pool *x509.CertPool
+	// allowed holds the accepted common names and SANs, empty allows any
+	// certificate signed by pool.
+	allowed map[string]bool
+}
+
+// newClientAuth loads the PEM CA bundle in caFile.
+func newClientAuth(caFile string, allowed []string) (*clientAuth, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	c := &clientAuth{pool: pool, allowed: map[string]bool{}}
+	for _, name := range allowed {
+		if name = strings.TrimSpace(name); name != "" {
+			c.allowed[name] = true
+		}
+	}
+	return c, nil
+}
+
+// configure adds client verification to cfg. Certificates are verified when
+// given but not required by the handshake, so the kubelet can still reach the
+// probes without one. serve refuses reviews from unverified callers.
+func (c *clientAuth) configure(cfg *tls.Config) {
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.ClientCAs = c.pool
+	cfg.VerifyPeerCertificate = c.verifyPeerCertificate
+}
+
+// verifyPeerCertificate runs after the chain was verified against pool and
+// fails the handshake for certificates that name no allowed client.
+func (c *clientAuth) verifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(c.allowed) == 0 {
+		return nil
+	}
+	leaf := chains[0][0]
+	names := certificateNames(leaf)
+	for _, name := range names {
+		if c.allowed[name] {
+			return nil
+		}
+	}
+	log.Warn("rejecting client certificate", "subject", leaf.Subject.String(), "names", names)
+	return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.CommonName)
+}
+
+// certificateNames returns the common name and the SANs of cert.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// verifiedClient reports whether r came with a certificate that passed
+// verification.
+func verifiedClient(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
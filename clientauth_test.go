@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientAuth(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	ca, err := newCA("client-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCA("other-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newClientAuth(caFile, []string{"kube-apiserver", " k8s-ac-test.example.com "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := newPolicyStore(filepath.Join("testdata", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &WebHookServer{policies: policies, requireClientCert: true}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(ws.serve))
+	srv.TLS = &tls.Config{}
+	auth.configure(srv.TLS)
+	srv.StartTLS()
+	defer srv.Close()
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "validate", "pod-allowed", "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		signer     *keyPair
+		commonName string
+		dnsNames   []string
+		// status is 0 when the handshake must fail
+		status int
+	}{
+		{name: "allowed common name", signer: ca, commonName: "kube-apiserver", status: http.StatusOK},
+		{name: "allowed SAN", signer: ca, commonName: "tester", dnsNames: []string{"k8s-ac-test.example.com"}, status: http.StatusOK},
+		{name: "no certificate", status: http.StatusUnauthorized},
+		{name: "name not allowed", signer: ca, commonName: "someone"},
+		// clients only send certificates issued by a CA the server asks for
+		{name: "untrusted CA", signer: other, commonName: "kube-apiserver", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := srv.Client().Transport.(*http.Transport).Clone()
+			if tt.signer != nil {
+				tmpl := &x509.Certificate{
+					Subject:     pkix.Name{CommonName: tt.commonName},
+					DNSNames:    tt.dnsNames,
+					KeyUsage:    x509.KeyUsageDigitalSignature,
+					ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				}
+				kp, err := newKeyPair(tmpl, tt.signer, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert, err := tls.X509KeyPair(kp.certPEM, kp.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+			}
+			client := &http.Client{Transport: transport}
+
+			resp, err := client.Post(srv.URL+"/validate", "application/json", bytes.NewReader(body))
+			if tt.status == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("request succeeded with status %d, want a failed handshake", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// evalUser is the user synthetic requests are made as.
+const evalUser = "k8s-ac-eval"
+
+type evalOptions struct {
+	namespace string
+	operation string
+}
+
+// evalResult is the outcome of running one object through the webhook.
+type evalResult struct {
+	name     string
+	denied   bool
+	messages []string
+	// object is the object after mutation, as JSON.
+	object []byte
+}
+
+// runEval implements the "eval" subcommand.
+func runEval(args []string) int {
+	opts := evalOptions{}
+	var file, policyFile string
+
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	fs.StringVar(&file, "f", "", "Manifest or AdmissionReview file to evaluate, - for stdin. YAML files may hold several documents.")
+	fs.StringVar(&policyFile, "policyFile", "", "Policy file to evaluate against. The built-in policy is used when empty.")
+	fs.StringVar(&opts.namespace, "namespace", "default", "Namespace of objects that do not set one.")
+	fs.StringVar(&opts.operation, "operation", string(v1beta1.Create), "Operation of the synthetic requests, CREATE or UPDATE. UPDATE requests have no old object.")
+	fs.Parse(args)
+	// the decision is the output, only report what went wrong
+	log.configure("text", "error", false)
+
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "usage: k8s-ac eval -f FILE [flags]")
+		return 2
+	}
+	if opts.operation != string(v1beta1.Create) && opts.operation != string(v1beta1.Update) {
+		fmt.Fprintf(os.Stderr, "invalid operation %q, must be CREATE or UPDATE\n", opts.operation)
+		return 2
+	}
+	policies, err := newPolicyStore(policyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid policy file %s: %v\n", policyFile, err)
+		return 1
+	}
+
+	var data []byte
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read %s: %v\n", file, err)
+		return 1
+	}
+	docs, err := splitDocuments(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not parse %s: %v\n", file, err)
+		return 1
+	}
+
+	ws := &WebHookServer{policies: policies}
+	policy := policies.Load().policy
+	status, written := 0, 0
+	for i, doc := range docs {
+		res, err := ws.eval(doc, policy, opts, i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "document %d: %v\n", i+1, err)
+			status = 1
+			continue
+		}
+		if res.denied {
+			status = 1
+		}
+		if written > 0 {
+			fmt.Println("---")
+		}
+		if err := writeEvalResult(os.Stdout, res); err != nil {
+			fmt.Fprintf(os.Stderr, "document %d: %v\n", i+1, err)
+			status = 1
+		}
+		written++
+	}
+	return status
+}
+
+// eval runs one document through mutate and then validate, the order the
+// API server calls the webhooks in. doc is an object or an AdmissionReview.
+func (ws *WebHookServer) eval(doc []byte, policy *Policy, opts evalOptions, index int) (*evalResult, error) {
+	ar, err := evalReview(doc, policy, opts, index)
+	if err != nil {
+		return nil, err
+	}
+	req := ar.Request
+	res := &evalResult{
+		name:   fmt.Sprintf("%s %s", req.Kind.Kind, req.Name),
+		object: req.Object.Raw,
+	}
+	if req.Namespace != "" {
+		res.name = fmt.Sprintf("%s %s/%s", req.Kind.Kind, req.Namespace, req.Name)
+	}
+
+	mutated := ws.mutate(ar, policy)
+	if !mutated.Allowed {
+		res.denied = true
+		res.messages = append(res.messages, "mutate: "+resultMessage(mutated))
+		return res, nil
+	}
+	for _, w := range mutated.Warnings {
+		res.messages = append(res.messages, "mutate warning: "+w)
+	}
+	if len(mutated.Patch) > 0 {
+		if res.object, err = applyPatch(req.Object.Raw, mutated.Patch); err != nil {
+			return nil, fmt.Errorf("applying patch %s: %v", mutated.Patch, err)
+		}
+		var ops []patchOperation
+		if err := json.Unmarshal(mutated.Patch, &ops); err != nil {
+			return nil, fmt.Errorf("decoding patch %s: %v", mutated.Patch, err)
+		}
+		for _, op := range ops {
+			res.messages = append(res.messages, fmt.Sprintf("mutate: %s %s", op.Op, op.Path))
+		}
+		req.Object.Raw = res.object
+	}
+
+	validated := ws.validate(ar, policy)
+	for _, w := range validated.Warnings {
+		res.messages = append(res.messages, "validate warning: "+w)
+	}
+	for _, v := range validated.violations {
+		if v.Mode == ModeAudit {
+			res.messages = append(res.messages, fmt.Sprintf("validate audit: %s: %s", v.Rule, v.Message))
+		}
+	}
+	if !validated.Allowed {
+		res.denied = true
+		res.messages = append(res.messages, "validate: "+resultMessage(validated))
+	}
+	return res, nil
+}
+
+// evalReview returns doc as an AdmissionReview, wrapping objects in a
+// synthetic dry-run request.
+func evalReview(doc []byte, policy *Policy, opts evalOptions, index int) (*v1beta1.AdmissionReview, error) {
+	tm := metav1.TypeMeta{}
+	if err := json.Unmarshal(doc, &tm); err != nil {
+		return nil, err
+	}
+	if tm.Kind == "AdmissionReview" {
+		ar, _, err := decodeReview(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ar.Request == nil {
+			return nil, fmt.Errorf("AdmissionReview has no request")
+		}
+		return ar, nil
+	}
+	if tm.Kind == "" || tm.APIVersion == "" {
+		return nil, fmt.Errorf("object has no apiVersion or kind")
+	}
+
+	meta := struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(doc, &meta); err != nil {
+		return nil, err
+	}
+	namespace := meta.Metadata.Namespace
+	if namespace == "" {
+		namespace = opts.namespace
+	}
+	group, version := "", tm.APIVersion
+	if i := strings.Index(tm.APIVersion, "/"); i >= 0 {
+		group, version = tm.APIVersion[:i], tm.APIVersion[i+1:]
+	}
+	gvk := metav1.GroupVersionKind{Group: group, Version: version, Kind: tm.Kind}
+	gvr := metav1.GroupVersionResource{Group: group, Version: version}
+	if kr, ok := policy.resourceFor(tm.Kind); ok {
+		gvr.Resource = kr.resource
+	}
+	dryRun := true
+	req := &v1beta1.AdmissionRequest{
+		UID:             types.UID(fmt.Sprintf("eval-%d", index+1)),
+		Kind:            gvk,
+		Resource:        gvr,
+		RequestKind:     &gvk,
+		RequestResource: &gvr,
+		Name:            meta.Metadata.Name,
+		Namespace:       namespace,
+		Operation:       v1beta1.Operation(opts.operation),
+		UserInfo:        authenticationv1.UserInfo{Username: evalUser},
+		Object:          runtime.RawExtension{Raw: doc},
+		DryRun:          &dryRun,
+	}
+	// UPDATE requests carry no old object, so nothing in doc is taken to be
+	// unchanged and every check runs
+	return &v1beta1.AdmissionReview{Request: req}, nil
+}
+
+func resultMessage(resp *admissionResponse) string {
+	if resp.Result == nil || resp.Result.Message == "" {
+		return "no reason given"
+	}
+	return resp.Result.Message
+}
+
+// writeEvalResult writes the decision and messages as YAML comments followed
+// by the mutated object, so the output can still be applied.
+func writeEvalResult(w io.Writer, res *evalResult) error {
+	decision := "allowed"
+	if res.denied {
+		decision = "denied"
+	}
+	fmt.Fprintf(w, "# %s: %s\n", res.name, decision)
+	for _, msg := range res.messages {
+		fmt.Fprintf(w, "#   %s\n", msg)
+	}
+	out, err := yaml.JSONToYAML(res.object)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// splitDocuments splits a YAML or JSON stream into one JSON document per
+// object. Items of a List are returned as separate documents.
+func splitDocuments(data []byte) ([][]byte, error) {
+	var docs [][]byte
+	var cur bytes.Buffer
+	flush := func() error {
+		defer cur.Reset()
+		if len(bytes.TrimSpace(cur.Bytes())) == 0 {
+			return nil
+		}
+		doc, err := yaml.YAMLToJSON(cur.Bytes())
+		if err != nil {
+			return err
+		}
+		if string(doc) == "null" {
+			return nil
+		}
+		list := struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}{}
+		if err := json.Unmarshal(doc, &list); err == nil && strings.HasSuffix(list.Kind, "List") && list.Items != nil {
+			for _, item := range list.Items {
+				docs = append(docs, item)
+			}
+			return nil
+		}
+		docs = append(docs, doc)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimRight(line, " \t") == "---" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
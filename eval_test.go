@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+func TestSplitDocuments(t *testing.T) {
+	data := `---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+---
+# only a comment
+---
+apiVersion: v1
+kind: List
+items:
+- {"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "a"}}
+- {"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "b"}}
+---
+{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "api"}}
+`
+	docs, err := splitDocuments([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, doc := range docs {
+		obj := struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(doc, &obj); err != nil {
+			t.Fatalf("invalid document %s: %v", doc, err)
+		}
+		names = append(names, obj.Kind+" "+obj.Metadata.Name)
+	}
+	want := []string{"Pod web", "Pod a", "Pod b", "Deployment api"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got documents %q, want %q", names, want)
+	}
+
+	if _, err := splitDocuments([]byte("kind: [Pod\n")); err == nil {
+		t.Errorf("invalid YAML: no error")
+	}
+}
+
+func TestEvalReview(t *testing.T) {
+	policy := defaultPolicy()
+	opts := evalOptions{namespace: "default", operation: string(v1beta1.Create)}
+
+	ar, err := evalReview([]byte(`{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "api", "namespace": "shop"}}`), policy, opts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ar.Request
+	if req.UID != "eval-2" || req.Namespace != "shop" || req.Name != "api" || req.Operation != v1beta1.Create {
+		t.Errorf("unexpected request %s %s/%s %s", req.UID, req.Namespace, req.Name, req.Operation)
+	}
+	if req.Kind.Group != "apps" || req.Kind.Version != "v1" || req.Resource.Resource != "deployments" {
+		t.Errorf("unexpected kind %v and resource %v", req.Kind, req.Resource)
+	}
+	if req.DryRun == nil || !*req.DryRun || len(req.OldObject.Raw) != 0 {
+		t.Errorf("want a dry run without an old object")
+	}
+
+	opts.operation = string(v1beta1.Update)
+	ar, err = evalReview([]byte(`{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web"}}`), policy, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := ar.Request; req.Namespace != "default" || req.Operation != v1beta1.Update || req.Resource.Resource != "pods" {
+		t.Errorf("unexpected request %s/%s %s %v", req.Namespace, req.Name, req.Operation, req.Resource)
+	}
+	// an old object equal to the object would make every update look like
+	// a metadata only change
+	if len(ar.Request.OldObject.Raw) != 0 {
+		t.Errorf("UPDATE has an old object")
+	}
+
+	review, err := ioutil.ReadFile(filepath.Join("testdata", "validate", "pod-allowed", "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar, err = evalReview(review, policy, opts, 0); err != nil || ar.Request.UID != "v-1" || ar.Request.Operation != v1beta1.Create {
+		t.Errorf("AdmissionReview is not passed through: %v", err)
+	}
+
+	for _, doc := range []string{`{"metadata": {"name": "web"}}`, `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`} {
+		if _, err := evalReview([]byte(doc), policy, opts, 0); err == nil {
+			t.Errorf("%s: no error", doc)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	policies, err := newPolicyStore(filepath.Join("testdata", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &WebHookServer{policies: policies}
+	policy := policies.Load().policy
+	opts := evalOptions{namespace: "default", operation: string(v1beta1.Create)}
+
+	tests := []struct {
+		name     string
+		doc      string
+		denied   bool
+		messages []string
+		object   string
+	}{
+		{
+			name:     "defaulted label",
+			doc:      `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web"}}`,
+			messages: []string{"mutate: add /metadata/labels"},
+			object:   `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "labels": {"team": "ops"}}}`,
+		},
+		{
+			name:     "value not allowed",
+			doc:      `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "labels": {"team": "qa"}}}`,
+			denied:   true,
+			messages: []string{`validate: label "team" value "qa" is not allowed, must be one of: ops, dev`},
+			object:   `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "labels": {"team": "qa"}}}`,
+		},
+		{
+			name:     "warn mode",
+			doc:      `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "namespace": "billing", "labels": {"team": "dev"}}}`,
+			messages: []string{`validate warning: cost-center: label "cost-center" is required`},
+			object:   `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "namespace": "billing", "labels": {"team": "dev"}}}`,
+		},
+		{
+			name:     "audit mode",
+			doc:      `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "namespace": "audited", "labels": {"team": "dev"}}}`,
+			messages: []string{`validate audit: owner: label "owner" is required`},
+			object:   `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "namespace": "audited", "labels": {"team": "dev"}}}`,
+		},
+	}
+	for i, tt := range tests {
+		res, err := ws.eval([]byte(tt.doc), policy, opts, i)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if res.denied != tt.denied || !reflect.DeepEqual(res.messages, tt.messages) {
+			t.Errorf("%s: denied %v with %q, want %v with %q", tt.name, res.denied, res.messages, tt.denied, tt.messages)
+		}
+		if !jsonEqual(res.object, json.RawMessage(tt.object)) {
+			t.Errorf("%s: object %s, want %s", tt.name, res.object, tt.object)
+		}
+	}
+}
+
+func TestEvalPodSecurityOnUpdate(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	policies, err := newPolicyStore(filepath.Join("testdata", "validate", "pod-security-baseline", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &WebHookServer{policies: policies}
+	doc := []byte(`{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "agent"}, "spec": {"hostNetwork": true,
+		"containers": [{"name": "agent", "image": "agent", "securityContext": {"privileged": true}}]}}`)
+	for _, op := range []v1beta1.Operation{v1beta1.Create, v1beta1.Update} {
+		res, err := ws.eval(doc, policies.Load().policy, evalOptions{namespace: "default", operation: string(op)}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.denied {
+			t.Errorf("%s of a privileged pod is allowed: %q", op, res.messages)
+		}
+	}
+}
+
+func TestRunEval(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	dir, err := ioutil.TempDir("", "eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowed := "apiVersion: v1\nkind: Pod\nmetadata:\n  name: web\n"
+	denied := "apiVersion: v1\nkind: Pod\nmetadata:\n  name: db\n  labels:\n    team: qa\n"
+
+	tests := []struct {
+		name     string
+		manifest string
+		args     []string
+		status   int
+		output   []string
+	}{
+		{name: "allowed", manifest: allowed, status: 0, output: []string{"# Pod default/web: allowed"}},
+		{name: "one denied", manifest: allowed + "---\n" + denied, status: 1, output: []string{"# Pod default/web: allowed", "# Pod default/db: denied"}},
+		{name: "not a manifest", manifest: "kind: [Pod\n", status: 1},
+		{name: "invalid operation", manifest: allowed, args: []string{"-operation", "DELETE"}, status: 2},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(dir, "manifest.yaml")
+		if err := ioutil.WriteFile(file, []byte(tt.manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-f", file, "-policyFile", filepath.Join("testdata", "policy.yaml")}, tt.args...)
+		status, output := runEvalOutput(t, dir, args)
+		if status != tt.status {
+			t.Errorf("%s: exit status %d, want %d", tt.name, status, tt.status)
+		}
+		var decisions []string
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "#  ") {
+				decisions = append(decisions, line)
+			}
+		}
+		if !reflect.DeepEqual(decisions, tt.output) {
+			t.Errorf("%s: decisions %q, want %q", tt.name, decisions, tt.output)
+		}
+	}
+}
+
+// runEvalOutput runs the eval subcommand with args and returns its exit
+// status and what it wrote to stdout. Errors on stderr are discarded.
+func runEvalOutput(t *testing.T, dir string, args []string) (int, string) {
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	savedOut, savedErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	status := runEval(args)
+	os.Stdout, os.Stderr = savedOut, savedErr
+	output, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(output)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health tracks what the liveness and readiness probes report on.
+type health struct {
+	certs *keyPairReloader
+	// stuckAfter is how long an admission request may be in flight before
+	// the serving loop is considered wedged.
+	stuckAfter time.Duration
+
+	shuttingDown int32 // atomic
+
+	mu          sync.Mutex
+	nextID      uint64
+	requests    map[uint64]time.Time
+	evaluations map[uint64]time.Time
+}
+
+func newHealth(certs *keyPairReloader, stuckAfter time.Duration) *health {
+	return &health{
+		certs:       certs,
+		stuckAfter:  stuckAfter,
+		requests:    map[uint64]time.Time{},
+		evaluations: map[uint64]time.Time{},
+	}
+}
+
+// track records the requests in flight through h.
+func (hl *health) track(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer hl.begin(hl.requests)()
+		h(w, r)
+	}
+}
+
+// evaluating records a policy evaluation until the returned func is called.
+// An evaluation that misses its deadline keeps running after its request was
+// answered, so it is tracked separately from the request.
+func (hl *health) evaluating() func() {
+	if hl == nil {
+		return func() {}
+	}
+	return hl.begin(hl.evaluations)
+}
+
+func (hl *health) begin(inflight map[uint64]time.Time) func() {
+	hl.mu.Lock()
+	hl.nextID++
+	id := hl.nextID
+	inflight[id] = time.Now()
+	hl.mu.Unlock()
+	return func() {
+		hl.mu.Lock()
+		delete(inflight, id)
+		hl.mu.Unlock()
+	}
+}
+
+// shutdown makes the server report unready so it is taken out of the
+// Service before it stops listening.
+func (hl *health) shutdown() {
+	atomic.StoreInt32(&hl.shuttingDown, 1)
+}
+
+// stuck returns the number of entries of inflight older than stuckAfter.
+func (hl *health) stuck(inflight map[uint64]time.Time) int {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	n := 0
+	for _, started := range inflight {
+		if time.Since(started) > hl.stuckAfter {
+			n++
+		}
+	}
+	return n
+}
+
+// live fails when requests or evaluations are not completing. Probes are
+// answered by the same server, so a listener that stopped accepting fails
+// them as well.
+func (hl *health) live() error {
+	if n := hl.stuck(hl.evaluations); n > 0 {
+		return fmt.Errorf("%d policy evaluations running for more than %s", n, hl.stuckAfter)
+	}
+	if n := hl.stuck(hl.requests); n > 0 {
+		return fmt.Errorf("%d admission requests in flight for more than %s", n, hl.stuckAfter)
+	}
+	return nil
+}
+
+// ready fails once shutdown has started and while the certificate being
+// served is not valid. The server only starts after a valid certificate and
+// policy are loaded, and reloads never replace them with invalid ones.
+func (hl *health) ready() error {
+	if atomic.LoadInt32(&hl.shuttingDown) != 0 {
+		return fmt.Errorf("shutting down")
+	}
+	leaf := hl.certs.leaf()
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate is only valid from %s to %s", leaf.NotBefore, leaf.NotAfter)
+	}
+	return hl.live()
+}
+
+// probeHandler answers 200 "ok" when check passes and 503 with the reason
+// otherwise.
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestLiveCountsEvaluations(t *testing.T) {
+	hl := newHealth(nil, 0)
+	if err := hl.live(); err != nil {
+		t.Fatalf("idle server is not live: %v", err)
+	}
+
+	// the request was answered, the evaluation behind it still runs
+	request := hl.begin(hl.requests)
+	evaluated := hl.evaluating()
+	request()
+	if err := hl.live(); err == nil || err.Error() != "1 policy evaluations running for more than 0s" {
+		t.Errorf("live() = %v, want the running evaluation reported", err)
+	}
+	evaluated()
+	if err := hl.live(); err != nil {
+		t.Errorf("live() = %v after the evaluation returned", err)
+	}
+
+	var none *health
+	none.evaluating()()
+}
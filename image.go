@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dockerHub is the registry of images that do not name one.
+const dockerHub = "docker.io"
+
+// imageRef is a parsed container image reference, such as
+// registry.example.com/team/app:1.2@sha256:....
+type imageRef struct {
+	// domain is the registry, docker.io for images that do not name one.
+	domain string
+	// path is the repository within the registry. Docker Hub images
+	// without an organisation are in library/.
+	path   string
+	tag    string
+	digest string
+}
+
+// parseImage parses a reference the way the container runtime resolves it.
+func parseImage(image string) (imageRef, error) {
+	if image == "" {
+		return imageRef{}, fmt.Errorf("image is empty")
+	}
+	if strings.ContainsAny(image, " \t\n") {
+		return imageRef{}, fmt.Errorf("image contains whitespace")
+	}
+	ref := imageRef{}
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+		if !strings.Contains(ref.digest, ":") {
+			return imageRef{}, fmt.Errorf("invalid digest %q", ref.digest)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+		if ref.tag == "" {
+			return imageRef{}, fmt.Errorf("empty tag")
+		}
+	}
+
+	ref.domain, ref.path = splitRepository(name)
+	if ref.domain == dockerHub && !strings.Contains(ref.path, "/") {
+		ref.path = "library/" + ref.path
+	}
+	for _, part := range strings.Split(ref.path, "/") {
+		if part == "" {
+			return imageRef{}, fmt.Errorf("empty path component in %q", name)
+		}
+	}
+	if ref.path != strings.ToLower(ref.path) {
+		return imageRef{}, fmt.Errorf("repository %q must be lowercase", ref.path)
+	}
+	return ref, nil
+}
+
+// splitRepository splits a repository name into registry and path. The
+// first component is the registry when it looks like a host name.
+func splitRepository(name string) (domain, path string) {
+	domain, path = dockerHub, name
+	if i := strings.Index(name, "/"); i >= 0 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			domain, path = host, name[i+1:]
+		}
+	}
+	if domain == "index.docker.io" {
+		domain = dockerHub
+	}
+	return domain, path
+}
+
+// repository returns the fully qualified repository, without tag or digest.
+func (r imageRef) repository() string {
+	return r.domain + "/" + r.path
+}
+
+func (r imageRef) String() string {
+	s := r.repository()
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// from reports whether the image is in repo: a registry such as
+// registry.example.com, or a repository prefix such as gcr.io/acme, which
+// matches gcr.io/acme and everything below it.
+func (r imageRef) from(repo string) bool {
+	repo = strings.TrimSuffix(repo, "/")
+	if !strings.Contains(repo, "/") {
+		domain, _ := splitRepository(repo + "/")
+		return r.domain == domain
+	}
+	domain, path := splitRepository(repo)
+	return r.domain == domain && (r.path == path || strings.HasPrefix(r.path, path+"/"))
+}
+
+// pinned reports whether the image is pinned by a well-formed sha256
+// digest: the algorithm and 64 lowercase hex characters.
+func (r imageRef) pinned() bool {
+	hex := strings.TrimPrefix(r.digest, "sha256:")
+	if hex == r.digest || len(hex) != 64 {
+		return false
+	}
+	for _, c := range hex {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  imageRef
+		err   bool
+	}{
+		{image: "nginx", want: imageRef{domain: "docker.io", path: "library/nginx"}},
+		{image: "nginx:1.19", want: imageRef{domain: "docker.io", path: "library/nginx", tag: "1.19"}},
+		{image: "acme/web", want: imageRef{domain: "docker.io", path: "acme/web"}},
+		{image: "index.docker.io/acme/web:2", want: imageRef{domain: "docker.io", path: "acme/web", tag: "2"}},
+		{image: "localhost/web", want: imageRef{domain: "localhost", path: "web"}},
+		{image: "registry.example.com:5000/team/web:1.2@sha256:abc", want: imageRef{domain: "registry.example.com:5000", path: "team/web", tag: "1.2", digest: "sha256:abc"}},
+		{image: "gcr.io/acme/web@sha256:abc", want: imageRef{domain: "gcr.io", path: "acme/web", digest: "sha256:abc"}},
+		{image: "", err: true},
+		{image: "nginx:", err: true},
+		{image: "nginx@abc", err: true},
+		{image: "gcr.io//web", err: true},
+		{image: "Acme/Web", err: true},
+		{image: "nginx latest", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseImage(tt.image)
+		if (err != nil) != tt.err {
+			t.Errorf("parseImage(%q) error = %v, want error %v", tt.image, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseImage(%q) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestImageFrom(t *testing.T) {
+	tests := []struct {
+		image string
+		repo  string
+		want  bool
+	}{
+		{"registry.example.com/team/web:1", "registry.example.com", true},
+		{"registry.example.com:5000/web", "registry.example.com", false},
+		{"registry.example.com:5000/web", "registry.example.com:5000", true},
+		{"gcr.io/acme/web", "gcr.io/acme", true},
+		{"gcr.io/acme/web", "gcr.io/acme/", true},
+		{"gcr.io/acme", "gcr.io/acme", true},
+		{"gcr.io/acme-mirror/web", "gcr.io/acme", false},
+		{"nginx", "docker.io", true},
+		{"nginx", "docker.io/library", true},
+		{"acme/web", "docker.io/acme", true},
+		{"acme/web", "index.docker.io", true},
+		{"evil.io/docker.io/web", "docker.io", false},
+	}
+	for _, tt := range tests {
+		ref, err := parseImage(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ref.from(tt.repo); got != tt.want {
+			t.Errorf("%q from %q = %v, want %v", tt.image, tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestRequireDigest(t *testing.T) {
+	const digest = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{"gcr.io/acme/web@sha256:" + digest, true},
+		{"gcr.io/acme/web:1.2@sha256:" + digest, true},
+		{"gcr.io/acme/web:1.2", false},
+		{"gcr.io/acme/web@sha256:abc", false},
+		{"gcr.io/acme/web@sha256:" + digest + "0", false},
+		{"gcr.io/acme/web@sha256:" + strings.ToUpper(digest), false},
+		{"gcr.io/acme/web@sha256:" + digest[1:] + "g", false},
+		{"gcr.io/acme/web@sha512:" + digest + digest, false},
+	}
+	rule := ImageRule{Name: "pinned", RequireDigest: true}
+	for _, tt := range tests {
+		if got := len(rule.check(tt.image)) == 0; got != tt.want {
+			t.Errorf("%q pinned = %v, want %v", tt.image, got, tt.want)
+		}
+	}
+}
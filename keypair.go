@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyPairReloader serves the certificate in certFile/keyFile and reloads it
+// when either file changes, so rotated secrets are picked up without a restart.
+type keyPairReloader struct {
+	certFile, keyFile string
+	current           atomic.Value // *tls.Certificate
+
+	mu              sync.Mutex
+	certPEM, keyPEM []byte
+	lastErr         error
+}
+
+// newKeyPairReloader loads the initial key pair. It fails when the pair is
+// missing, malformed or not currently valid.
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	k := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (k *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.current.Load().(*tls.Certificate), nil
+}
+
+// leaf returns the parsed serving certificate.
+func (k *keyPairReloader) leaf() *x509.Certificate {
+	return k.current.Load().(*tls.Certificate).Leaf
+}
+
+// reload re-reads both files and swaps in the new pair if it changed and is
+// valid. On error the previous pair keeps being served.
+func (k *keyPairReloader) reload() (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	certPEM, err := ioutil.ReadFile(k.certFile)
+	if err != nil {
+		k.lastErr = err
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(k.keyFile)
+	if err != nil {
+		k.lastErr = err
+		return false, err
+	}
+	if bytes.Equal(certPEM, k.certPEM) && bytes.Equal(keyPEM, k.keyPEM) {
+		k.lastErr = nil
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		k.lastErr = err
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		k.lastErr = err
+		return false, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		k.lastErr = fmt.Errorf("certificate is only valid from %s to %s", leaf.NotBefore, leaf.NotAfter)
+		return false, k.lastErr
+	}
+	cert.Leaf = leaf
+
+	k.current.Store(&cert)
+	k.certPEM, k.keyPEM = certPEM, keyPEM
+	k.lastErr = nil
+	return true, nil
+}
+
+// watch polls the key pair every interval until stop is closed.
+func (k *keyPairReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			prev := k.lastError()
+			changed, err := k.reload()
+			if err != nil {
+				if prev != nil && prev.Error() == err.Error() {
+					continue
+				}
+				log.Error("failed to reload key pair, keeping current certificate",
+					"certFile", k.certFile, "notAfter", k.leaf().NotAfter, "error", err)
+				continue
+			}
+			if changed {
+				log.Info("loaded certificate", "certFile", k.certFile, "notAfter", k.leaf().NotAfter)
+			}
+		}
+	}
+}
+
+func (k *keyPairReloader) lastError() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lastErr
+}
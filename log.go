@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// logLevel orders log records by severity.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// logSink is where the records of a logger and all loggers derived from it
+// with With are written.
+type logSink struct {
+	mu       sync.Mutex
+	out      io.Writer
+	json     bool
+	minLevel logLevel
+	// showUserExtra disables the redaction of UserInfo.Extra.
+	showUserExtra bool
+}
+
+// logger writes leveled records with key/value fields, as text or JSON.
+type logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+// log is the process wide logger, configured from the flags in main.
+var log = newLogger(os.Stderr, "text", levelInfo)
+
+func newLogger(out io.Writer, format string, minLevel logLevel) *logger {
+	return &logger{sink: &logSink{out: out, json: format == "json", minLevel: minLevel}}
+}
+
+// configure sets the output format, minimum level and redaction of the
+// logger in place, so loggers derived from it pick up the change.
+func (l *logger) configure(format, level string, showUserExtra bool) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	minLevel, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.json = format == "json"
+	l.sink.minLevel = minLevel
+	l.sink.showUserExtra = showUserExtra
+	return nil
+}
+
+// With returns a logger that adds the key/value pairs kv to every record.
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{sink: l.sink, fields: fields}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// Fatal logs at error level and exits.
+func (l *logger) Fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	s := l.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level < s.minLevel {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	if s.json {
+		buf.WriteString(`{"time":`)
+		buf.WriteString(strconv.Quote(now))
+		buf.WriteString(`,"level":`)
+		buf.WriteString(strconv.Quote(level.String()))
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, s.value(fields[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&buf, " %v=%s", fields[i], textValue(s.value(fields[i+1])))
+		}
+		buf.WriteByte('\n')
+	}
+	s.out.Write(buf.Bytes())
+}
+
+// value prepares a field value for output, turning errors into their
+// message and redacting user info.
+func (s *logSink) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case authenticationv1.UserInfo:
+		return userInfoFields(v, s.showUserExtra)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// redacted replaces the values of sensitive fields.
+const redacted = "[REDACTED]"
+
+// userInfoFields is the loggable form of a UserInfo. Extra can carry
+// credentials such as token scopes or session ids, so its values are
+// redacted unless showExtra is set.
+func userInfoFields(u authenticationv1.UserInfo, showExtra bool) map[string]interface{} {
+	out := map[string]interface{}{"username": u.Username}
+	if u.UID != "" {
+		out["uid"] = u.UID
+	}
+	if len(u.Groups) > 0 {
+		out["groups"] = u.Groups
+	}
+	if len(u.Extra) > 0 {
+		extra := make(map[string]interface{}, len(u.Extra))
+		for key, values := range u.Extra {
+			if showExtra {
+				extra[key] = []string(values)
+			} else {
+				extra[key] = redacted
+			}
+		}
+		out["extra"] = extra
+	}
+	return out
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// textValue formats a field for the text format, quoting strings that
+// contain spaces or quotes and rendering structured values as JSON.
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []string, map[string]interface{}, map[string]string, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
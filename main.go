@@ -8,9 +8,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-
-	"github.com/golang/glog"
+	"time"
 )
 
 const (
@@ -18,47 +18,183 @@ const (
 )
 
 var (
-	tlscert, tlskey string
+	tlscert, tlskey   string
+	policyFile        string
+	policyReload      time.Duration
+	tlsReload         time.Duration
+	metricsAddr       string
+	shutdownDelay     time.Duration
+	auditSink         string
+	auditMaxSize      int64
+	auditMaxAge       time.Duration
+	logFormat         string
+	logMinLevel       string
+	logUserExtra      bool
+	maxRequestBytes   int64
+	timeoutSeconds    int
+	timeoutPolicy     string
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	stuckAfter        time.Duration
+	clientCAFile      string
+	allowedClients    string
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "certs":
+			os.Exit(runCerts(os.Args[2:]))
+		case "manifests":
+			os.Exit(runManifests(os.Args[2:]))
+		case "eval":
+			os.Exit(runEval(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
 
 	flag.StringVar(&tlscert, "tlsCertFile", "/etc/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&tlskey, "tlsKeyFile", "/etc/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&policyFile, "policyFile", "", "YAML or JSON policy file. The built-in 'team: ops' policy is used when empty.")
+
+	flag.DurationVar(&tlsReload, "tlsReloadInterval", 30*time.Second, "How often to check --tlsCertFile and --tlsKeyFile for changes.")
+	flag.DurationVar(&policyReload, "policyReloadInterval", 10*time.Second, "How often to check --policyFile for changes.")
+
+	flag.StringVar(&metricsAddr, "metricsAddr", ":9090", "Plain HTTP address to serve /metrics on, disabled when empty.")
+
+	flag.DurationVar(&shutdownDelay, "shutdownDelay", 5*time.Second, "How long to report unready before shutting down, so the Service stops sending requests.")
+	flag.DurationVar(&stuckAfter, "stuckRequestTimeout", 30*time.Second, "How long an admission request or policy evaluation may run before /healthz reports the server as wedged.")
+
+	flag.StringVar(&auditSink, "auditLog", "stdout", "Where to write the JSON audit log: stdout, a file path, or empty to disable. Without it, audit mode violations are logged at info level.")
+	flag.Int64Var(&auditMaxSize, "auditLogMaxSize", 100<<20, "Size in bytes at which the --auditLog file is rotated.")
+	flag.DurationVar(&auditMaxAge, "auditLogMaxAge", 7*24*time.Hour, "How long rotated --auditLog files are kept.")
+
+	flag.StringVar(&logFormat, "logFormat", "text", "Log format, text or json.")
+	flag.StringVar(&logMinLevel, "logLevel", "info", "Minimum level logged: debug, info, warn or error.")
+	flag.BoolVar(&logUserExtra, "logUserExtra", false, "Log the values of UserInfo.Extra instead of redacting them.")
+
+	flag.Int64Var(&maxRequestBytes, "maxRequestBytes", 8<<20, "Largest AdmissionReview accepted, in bytes.")
+	flag.IntVar(&timeoutSeconds, "timeoutSeconds", 10, "The webhooks' timeoutSeconds. Requests are answered according to --timeoutPolicy shortly before it passes.")
+	flag.StringVar(&timeoutPolicy, "timeoutPolicy", "Ignore", "Answer to requests not evaluated in time: Ignore allows them, Fail denies them.")
+	flag.DurationVar(&readHeaderTimeout, "readHeaderTimeout", 5*time.Second, "Maximum duration for reading the headers of a request.")
+	flag.DurationVar(&readTimeout, "readTimeout", 10*time.Second, "Maximum duration for reading a request, including its body.")
+	flag.DurationVar(&writeTimeout, "writeTimeout", 35*time.Second, "Maximum duration from the end of the request headers to the end of the response.")
+	flag.DurationVar(&idleTimeout, "idleTimeout", 90*time.Second, "How long keep-alive connections are kept open without requests.")
+
+	flag.StringVar(&clientCAFile, "clientCAFile", "", "PEM bundle of the CAs client certificates must be signed by. When set, reviews are only accepted from callers with a verified certificate.")
+	flag.StringVar(&allowedClients, "allowedClientNames", "", "Comma separated common names or SANs a client certificate must carry one of. Any certificate signed by --clientCAFile is accepted when empty.")
 
 	flag.Parse()
 
-	certs, err := tls.LoadX509KeyPair(tlscert, tlskey)
+	if err := log.configure(logFormat, logMinLevel, logUserExtra); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	policies, err := newPolicyStore(policyFile)
 	if err != nil {
-		glog.Errorf("Filed to load key pair: %v", err)
+		log.Fatal("invalid policy file", "file", policyFile, "error", err)
+	}
+	log.Info("loaded policy", "source", policies.Load().source, "revision", policies.Load().revision)
+	stop := make(chan struct{})
+	go policies.watch(policyReload, stop)
+
+	certs, err := newKeyPairReloader(tlscert, tlskey)
+	if err != nil {
+		log.Fatal("failed to load key pair", "certFile", tlscert, "keyFile", tlskey, "error", err)
+	}
+	log.Info("loaded certificate", "certFile", tlscert, "notAfter", certs.leaf().NotAfter)
+	go certs.watch(tlsReload, stop)
+
+	if timeoutPolicy != "Ignore" && timeoutPolicy != "Fail" {
+		log.Fatal("invalid timeout policy, must be Ignore or Fail", "timeoutPolicy", timeoutPolicy)
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+	switch {
+	case clientCAFile != "":
+		auth, err := newClientAuth(clientCAFile, strings.Split(allowedClients, ","))
+		if err != nil {
+			log.Fatal("failed to load client CA bundle", "clientCAFile", clientCAFile, "error", err)
+		}
+		auth.configure(tlsConfig)
+		log.Info("verifying client certificates", "clientCAFile", clientCAFile, "allowedClientNames", allowedClients)
+	case allowedClients != "":
+		log.Fatal("--allowedClientNames requires --clientCAFile")
 	}
 
 	server := &http.Server{
-		Addr:      fmt.Sprintf(":%v", port),
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs}},
+		Addr:              fmt.Sprintf(":%v", port),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
 	}
 
 	// define http server and server handler
-	ws := WebHookServer{}
+	var audit *auditLog
+	if auditSink != "" {
+		if audit, err = newAuditLog(auditSink, auditMaxSize, auditMaxAge); err != nil {
+			log.Fatal("failed to open audit log", "sink", auditSink, "error", err)
+		}
+		defer audit.Close()
+	}
+
+	hl := newHealth(certs, stuckAfter)
+	ws := WebHookServer{
+		policies:          policies,
+		audit:             audit,
+		maxRequestBytes:   maxRequestBytes,
+		timeout:           time.Duration(timeoutSeconds) * time.Second,
+		failOpen:          timeoutPolicy == "Ignore",
+		requireClientCert: clientCAFile != "",
+		health:            hl,
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", ws.serve)
-	mux.HandleFunc("/validate", ws.serve)
+	mux.HandleFunc("/mutate", hl.track(ws.serve))
+	mux.HandleFunc("/validate", hl.track(ws.serve))
+	mux.HandleFunc("/statusz", statusHandler(policies, certs))
+	mux.HandleFunc("/healthz", probeHandler(hl.live))
+	mux.HandleFunc("/readyz", probeHandler(hl.ready))
 	server.Handler = mux
 
 	// start webhook server in new rountine
 	go func() {
 		if err := server.ListenAndServeTLS("", ""); err != nil {
-			glog.Errorf("Failed to listen and serve webhook server: %v", err)
+			log.Error("failed to listen and serve webhook server", "error", err)
 		}
 	}()
 
-	glog.Infof("Server running listening in port: %s", port)
+	log.Info("server listening", "port", port)
+
+	var metricsServer *http.Server
+	if metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", metricsHandler(policies, certs))
+		metricsServer = &http.Server{Addr: metricsAddr, Handler: metricsMux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error("failed to serve metrics", "error", err)
+			}
+		}()
+		log.Info("serving metrics", "addr", metricsAddr)
+	}
 
 	// listening shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	glog.Info("Got shutdown signal, shutting down webhook server gracefully...")
+	log.Info("got shutdown signal, shutting down webhook server gracefully")
+	hl.shutdown()
+	time.Sleep(shutdownDelay)
+	close(stop)
 	server.Shutdown(context.Background())
+	if metricsServer != nil {
+		metricsServer.Shutdown(context.Background())
+	}
 }
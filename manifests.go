@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// kindResource is the API group and resource the API server uses for a kind.
+type kindResource struct {
+	group, resource string
+}
+
+// knownKinds maps built-in kinds to their API resource. Other kinds must be
+// declared in the policy's customKinds.
+var knownKinds = map[string]kindResource{
+	"Pod":                   {"", "pods"},
+	"ReplicationController": {"", "replicationcontrollers"},
+	"Deployment":            {"apps", "deployments"},
+	"StatefulSet":           {"apps", "statefulsets"},
+	"DaemonSet":             {"apps", "daemonsets"},
+	"ReplicaSet":            {"apps", "replicasets"},
+	"Job":                   {"batch", "jobs"},
+	"CronJob":               {"batch", "cronjobs"},
+}
+
+// defaultKinds are registered for label rules that do not list any kinds.
+var defaultKinds = []string{"Pod", "Deployment"}
+
+// namespaceNameLabel is set on every namespace by Kubernetes 1.21 and later.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// metricsPort is the container port -metricsAddr listens on in the Deployment.
+const metricsPort = 9090
+
+type manifestOptions struct {
+	name           string
+	namespace      string
+	service        string
+	secret         string
+	image          string
+	replicas       int
+	caBundle       []byte
+	timeoutSeconds int
+	failurePolicy  string
+	policyData     []byte
+}
+
+// runManifests implements the "manifests" subcommand.
+func runManifests(args []string) int {
+	opts := manifestOptions{}
+	var policyFile, caFile, caBundle, out string
+
+	fs := flag.NewFlagSet("manifests", flag.ExitOnError)
+	fs.StringVar(&policyFile, "policyFile", "", "Policy file to derive the webhook rules from and ship in a ConfigMap.")
+	fs.StringVar(&opts.name, "name", "k8s-ac", "Name of the Deployment and webhook configurations.")
+	fs.StringVar(&opts.namespace, "namespace", "default", "Namespace to deploy the webhook to.")
+	fs.StringVar(&opts.service, "service", "k8s-ac-svc", "Service name of the webhook.")
+	fs.StringVar(&opts.secret, "secret", "k8s-ac", "Secret holding cert.pem and key.pem.")
+	fs.StringVar(&opts.image, "image", "a1zk/k8s-ac:1.0.0", "Webhook container image.")
+	fs.IntVar(&opts.replicas, "replicas", 1, "Number of webhook replicas.")
+	fs.StringVar(&caFile, "caFile", "", "PEM file with the CA that signed the serving certificate.")
+	fs.StringVar(&caBundle, "caBundle", "", "Base64 encoded caBundle, as printed by 'certs generate'.")
+	fs.IntVar(&opts.timeoutSeconds, "timeoutSeconds", 10, "Webhook timeout in seconds (1-30).")
+	fs.StringVar(&opts.failurePolicy, "failurePolicy", string(admissionregistrationv1.Ignore), "Webhook failure policy, Ignore or Fail.")
+	fs.StringVar(&out, "o", "", "File to write the manifests to instead of stdout.")
+	fs.Parse(args)
+
+	policy := defaultPolicy()
+	if policyFile != "" {
+		data, err := ioutil.ReadFile(policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read policy: %v\n", err)
+			return 1
+		}
+		if policy, err = parsePolicy(data); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid policy file %s: %v\n", policyFile, err)
+			return 1
+		}
+		opts.policyData = data
+	}
+
+	switch {
+	case caFile != "":
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read CA: %v\n", err)
+			return 1
+		}
+		opts.caBundle = data
+	case caBundle != "":
+		data, err := base64.StdEncoding.DecodeString(caBundle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid caBundle: %v\n", err)
+			return 1
+		}
+		opts.caBundle = data
+	}
+
+	manifests, err := buildManifests(opts, policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate manifests: %v\n", err)
+		return 1
+	}
+	if out == "" {
+		os.Stdout.Write(manifests)
+		return 0
+	}
+	if err := ioutil.WriteFile(out, manifests, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write manifests: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// buildManifests renders all objects needed to run the webhook as a
+// multi-document YAML stream.
+func buildManifests(opts manifestOptions, policy *Policy) ([]byte, error) {
+	if opts.timeoutSeconds < 1 || opts.timeoutSeconds > 30 {
+		return nil, fmt.Errorf("timeoutSeconds must be between 1 and 30, got %d", opts.timeoutSeconds)
+	}
+	failurePolicy := admissionregistrationv1.FailurePolicyType(opts.failurePolicy)
+	if failurePolicy != admissionregistrationv1.Ignore && failurePolicy != admissionregistrationv1.Fail {
+		return nil, fmt.Errorf("failurePolicy must be Ignore or Fail, got %q", opts.failurePolicy)
+	}
+	rules, err := webhookRules(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []interface{}
+	if opts.policyData != nil {
+		objects = append(objects, policyConfigMap(opts))
+	}
+	objects = append(objects, webhookService(opts), webhookDeployment(opts))
+
+	selector := namespaceSelector(policy, opts.namespace)
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	matchPolicy := admissionregistrationv1.Equivalent
+	timeout := int32(opts.timeoutSeconds)
+	reviewVersions := []string{"v1", "v1beta1"}
+	clientConfig := func(path string) admissionregistrationv1.WebhookClientConfig {
+		port := int32(443)
+		return admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{
+				Namespace: opts.namespace,
+				Name:      opts.service,
+				Path:      &path,
+				Port:      &port,
+			},
+			CABundle: opts.caBundle,
+		}
+	}
+
+	objects = append(objects, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: opts.name, Labels: map[string]string{"name": opts.name}},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name:                    fmt.Sprintf("validate.%s.%s.svc", opts.service, opts.namespace),
+			ClientConfig:            clientConfig("/validate"),
+			Rules:                   rules,
+			FailurePolicy:           &failurePolicy,
+			MatchPolicy:             &matchPolicy,
+			NamespaceSelector:       selector,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: reviewVersions,
+		}},
+	})
+	objects = append(objects, &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: opts.name, Labels: map[string]string{"name": opts.name}},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:                    fmt.Sprintf("mutate.%s.%s.svc", opts.service, opts.namespace),
+			ClientConfig:            clientConfig("/mutate"),
+			Rules:                   rules,
+			FailurePolicy:           &failurePolicy,
+			MatchPolicy:             &matchPolicy,
+			NamespaceSelector:       selector,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: reviewVersions,
+		}},
+	})
+
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		data, err := toYAML(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// resourceFor returns the API resource of kind, a built-in kind or one of
+// the policy's customKinds.
+func (p *Policy) resourceFor(kind string) (kindResource, bool) {
+	if kr, ok := knownKinds[kind]; ok {
+		return kr, true
+	}
+	for _, c := range p.CustomKinds {
+		if c.Kind == kind {
+			return kindResource{c.Group, c.Resource}, true
+		}
+	}
+	return kindResource{}, false
+}
+
+// webhookRules registers CREATE and UPDATE for every kind the policy covers.
+// Image, mirror and pod security rules also register the subresource
+// ephemeral containers are added through.
+func webhookRules(p *Policy) ([]admissionregistrationv1.RuleWithOperations, error) {
+	kinds := make(map[string]bool)
+	for _, r := range p.Labels {
+		if len(r.Kinds) == 0 {
+			for _, k := range defaultKinds {
+				kinds[k] = true
+			}
+		}
+		for _, k := range r.Kinds {
+			kinds[k] = true
+		}
+	}
+	// images are checked and mirrored, resources and security contexts
+	// defaulted and pod security checked in pods and in every kind with a
+	// pod template
+	if len(p.Images) > 0 || len(p.Mirrors) > 0 || len(p.Resources) > 0 || len(p.PodSecurity) > 0 || len(p.SecurityDefaults) > 0 {
+		for k := range knownKinds {
+			kinds[k] = true
+		}
+	}
+
+	groups := make(map[string][]string)
+	for kind := range kinds {
+		kr, ok := p.resourceFor(kind)
+		if !ok {
+			return nil, fmt.Errorf("kind %q has no known resource, declare it in customKinds", kind)
+		}
+		groups[kr.group] = append(groups[kr.group], kr.resource)
+	}
+	if len(p.Images) > 0 || len(p.Mirrors) > 0 || len(p.PodSecurity) > 0 {
+		groups[""] = append(groups[""], "pods/ephemeralcontainers")
+	}
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+
+	var rules []admissionregistrationv1.RuleWithOperations
+	for _, g := range names {
+		resources := groups[g]
+		sort.Strings(resources)
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{g},
+				APIVersions: []string{"*"},
+				Resources:   resources,
+			},
+		})
+	}
+	return rules, nil
+}
+
+// namespaceSelector limits the webhook to the namespaces named by the
+// policy. When any rule applies cluster wide, only kube-system and the
+// webhook's own namespace are excluded so the webhook cannot block itself.
+func namespaceSelector(p *Policy, ownNamespace string) *metav1.LabelSelector {
+	scopes := make([][]string, 0, len(p.Labels)+len(p.Images)+len(p.Mirrors)+len(p.Resources)+len(p.PodSecurity)+len(p.SecurityDefaults))
+	for _, r := range p.Labels {
+		scopes = append(scopes, r.Namespaces)
+	}
+	for _, r := range p.Images {
+		scopes = append(scopes, r.Namespaces)
+	}
+	for _, r := range p.Mirrors {
+		scopes = append(scopes, r.Namespaces)
+	}
+	for _, r := range p.Resources {
+		scopes = append(scopes, r.Namespaces)
+	}
+	for _, r := range p.PodSecurity {
+		scopes = append(scopes, r.Namespaces)
+	}
+	for _, r := range p.SecurityDefaults {
+		scopes = append(scopes, r.Namespaces)
+	}
+	namespaces := make(map[string]bool)
+	for _, scope := range scopes {
+		if len(scope) == 0 {
+			return &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      namespaceNameLabel,
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   []string{"kube-system", ownNamespace},
+				}},
+			}
+		}
+		for _, ns := range scope {
+			namespaces[ns] = true
+		}
+	}
+	values := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		values = append(values, ns)
+	}
+	sort.Strings(values)
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      namespaceNameLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   values,
+		}},
+	}
+}
+
+func policyConfigMap(opts manifestOptions) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.name + "-policy",
+			Namespace: opts.namespace,
+			Labels:    map[string]string{"name": opts.name},
+		},
+		Data: map[string]string{"policy.yaml": string(opts.policyData)},
+	}
+}
+
+func webhookService(opts manifestOptions) *v1.Service {
+	return &v1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.service,
+			Namespace: opts.namespace,
+			Labels:    map[string]string{"name": opts.name},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{
+				Name:       "webhook",
+				Port:       443,
+				TargetPort: intstr.FromString("webhook"),
+			}},
+			Selector: map[string]string{"name": opts.name},
+		},
+	}
+}
+
+func webhookDeployment(opts manifestOptions) *appsv1.Deployment {
+	labels := map[string]string{"name": opts.name}
+	replicas := int32(opts.replicas)
+	readOnly := true
+	containerPort, _ := strconv.Atoi(port)
+
+	args := []string{
+		"-logFormat=json",
+		"-tlsCertFile=/etc/certs/cert.pem",
+		"-tlsKeyFile=/etc/certs/key.pem",
+		fmt.Sprintf("-metricsAddr=:%d", metricsPort),
+		fmt.Sprintf("-timeoutSeconds=%d", opts.timeoutSeconds),
+		"-timeoutPolicy=" + opts.failurePolicy,
+	}
+	mounts := []v1.VolumeMount{{Name: "webhook-certs", MountPath: "/etc/certs", ReadOnly: true}}
+	volumes := []v1.Volume{{
+		Name:         "webhook-certs",
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: opts.secret}},
+	}}
+	if opts.policyData != nil {
+		args = append(args, "-policyFile=/etc/webhook/policy.yaml")
+		mounts = append(mounts, v1.VolumeMount{Name: "webhook-policy", MountPath: "/etc/webhook", ReadOnly: true})
+		volumes = append(volumes, v1.Volume{
+			Name: "webhook-policy",
+			VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{
+				LocalObjectReference: v1.LocalObjectReference{Name: opts.name + "-policy"},
+			}},
+		})
+	}
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.name,
+			Namespace: opts.namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						"prometheus.io/scrape": "true",
+						"prometheus.io/port":   strconv.Itoa(metricsPort),
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  "webhook",
+						Image: opts.image,
+						Args:  args,
+						Ports: []v1.ContainerPort{
+							{Name: "webhook", ContainerPort: int32(containerPort)},
+							{Name: "metrics", ContainerPort: metricsPort},
+						},
+						VolumeMounts: mounts,
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceCPU:    resource.MustParse("100m"),
+								v1.ResourceMemory: resource.MustParse("50Mi"),
+							},
+							Limits: v1.ResourceList{
+								v1.ResourceCPU:    resource.MustParse("300m"),
+								v1.ResourceMemory: resource.MustParse("50Mi"),
+							},
+						},
+						ReadinessProbe:  webhookProbe("/readyz", 5, 1),
+						LivenessProbe:   webhookProbe("/healthz", 10, 3),
+						SecurityContext: &v1.SecurityContext{ReadOnlyRootFilesystem: &readOnly},
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// webhookProbe checks path on the webhook's HTTPS port.
+func webhookProbe(path string, period, failures int32) *v1.Probe {
+	return &v1.Probe{
+		Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{
+			Path:   path,
+			Port:   intstr.FromString("webhook"),
+			Scheme: v1.URISchemeHTTPS,
+		}},
+		PeriodSeconds:    period,
+		FailureThreshold: failures,
+	}
+}
+
+// toYAML renders obj without the empty status and creationTimestamp fields
+// the typed API structs always carry.
+func toYAML(obj interface{}) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "status")
+	pruneCreationTimestamps(m)
+	return yaml.Marshal(m)
+}
+
+func pruneCreationTimestamps(v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if ts, ok := t["creationTimestamp"]; ok && ts == nil {
+			delete(t, "creationTimestamp")
+		}
+		for _, child := range t {
+			pruneCreationTimestamps(child)
+		}
+	case []interface{}:
+		for _, child := range t {
+			pruneCreationTimestamps(child)
+		}
+	}
+}
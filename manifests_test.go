@@ -0,0 +1,198 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestWebhookRules(t *testing.T) {
+	workloads := map[string][]string{
+		"":      {"pods", "replicationcontrollers"},
+		"apps":  {"daemonsets", "deployments", "replicasets", "statefulsets"},
+		"batch": {"cronjobs", "jobs"},
+	}
+	withEphemeral := map[string][]string{
+		"":      {"pods", "pods/ephemeralcontainers", "replicationcontrollers"},
+		"apps":  workloads["apps"],
+		"batch": workloads["batch"],
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		want   map[string][]string // resources by API group
+		err    string
+	}{
+		{
+			name:   "labels default kinds",
+			policy: Policy{Labels: []LabelRule{{Name: "team", Key: "team"}}},
+			want:   map[string][]string{"": {"pods"}, "apps": {"deployments"}},
+		},
+		{
+			name: "labels with kinds",
+			policy: Policy{
+				Labels:      []LabelRule{{Name: "team", Key: "team", Kinds: []string{"Job", "Widget"}}},
+				CustomKinds: []CustomKind{{Kind: "Widget", Group: "example.com", Resource: "widgets"}},
+			},
+			want: map[string][]string{"batch": {"jobs"}, "example.com": {"widgets"}},
+		},
+		{
+			name:   "labels with undeclared kind",
+			policy: Policy{Labels: []LabelRule{{Name: "team", Key: "team", Kinds: []string{"Widget"}}}},
+			err:    `kind "Widget" has no known resource`,
+		},
+		{
+			name:   "images",
+			policy: Policy{Images: []ImageRule{{Name: "registry", Repositories: []string{"gcr.io"}}}},
+			want:   withEphemeral,
+		},
+		{
+			name:   "mirrors",
+			policy: Policy{Mirrors: []MirrorRule{{Name: "mirror", From: "docker.io", To: "mirror.example.com"}}},
+			want:   withEphemeral,
+		},
+		{
+			name:   "resources",
+			policy: Policy{Resources: []ResourceRule{{Name: "bounds"}}},
+			want:   workloads,
+		},
+		{
+			name:   "pod security",
+			policy: Policy{PodSecurity: []PodSecurityRule{{Name: "pss", Level: LevelBaseline}}},
+			want:   withEphemeral,
+		},
+		{
+			name:   "security defaults",
+			policy: Policy{SecurityDefaults: []SecurityDefaultsRule{{Name: "harden"}}},
+			want:   workloads,
+		},
+	}
+	for _, tt := range tests {
+		rules, err := webhookRules(&tt.policy)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := make(map[string][]string)
+		for _, r := range rules {
+			ops := []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update}
+			if !reflect.DeepEqual(r.Operations, ops) || len(r.APIGroups) != 1 || !reflect.DeepEqual(r.APIVersions, []string{"*"}) {
+				t.Errorf("%s: unexpected rule %+v", tt.name, r)
+				continue
+			}
+			got[r.APIGroups[0]] = r.Resources
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNamespaceSelector(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   metav1.LabelSelectorRequirement
+	}{
+		{
+			name: "namespaced rules",
+			policy: Policy{
+				Labels:           []LabelRule{{Name: "team", Key: "team", Namespaces: []string{"web", "api"}}},
+				Images:           []ImageRule{{Name: "registry", Namespaces: []string{"api"}}},
+				Mirrors:          []MirrorRule{{Name: "mirror", Namespaces: []string{"batch"}}},
+				Resources:        []ResourceRule{{Name: "bounds", Namespaces: []string{"data"}}},
+				PodSecurity:      []PodSecurityRule{{Name: "pss", Namespaces: []string{"edge"}}},
+				SecurityDefaults: []SecurityDefaultsRule{{Name: "harden", Namespaces: []string{"ci"}}},
+			},
+			want: metav1.LabelSelectorRequirement{
+				Key:      namespaceNameLabel,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   []string{"api", "batch", "ci", "data", "edge", "web"},
+			},
+		},
+		{
+			name: "cluster wide rule",
+			policy: Policy{
+				Labels:           []LabelRule{{Name: "team", Key: "team", Namespaces: []string{"web"}}},
+				SecurityDefaults: []SecurityDefaultsRule{{Name: "harden"}},
+			},
+			want: metav1.LabelSelectorRequirement{
+				Key:      namespaceNameLabel,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"kube-system", "k8s-ac"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := namespaceSelector(&tt.policy, "k8s-ac")
+		want := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{tt.want}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestBuildManifests(t *testing.T) {
+	opts := manifestOptions{
+		name:           "k8s-ac",
+		namespace:      "infra",
+		service:        "k8s-ac-svc",
+		secret:         "k8s-ac",
+		image:          "a1zk/k8s-ac:1.0.0",
+		replicas:       2,
+		caBundle:       []byte("ca"),
+		timeoutSeconds: 10,
+		failurePolicy:  "Fail",
+		policyData:     []byte("labels: []\n"),
+	}
+	data, err := buildManifests(opts, defaultPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, doc := range strings.Split(string(data), "---\n")[1:] {
+		obj := metav1.TypeMeta{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			t.Fatalf("invalid document %q: %v", doc, err)
+		}
+		kinds = append(kinds, obj.Kind)
+		if obj.Kind != "ValidatingWebhookConfiguration" {
+			continue
+		}
+		config := admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := yaml.Unmarshal([]byte(doc), &config); err != nil {
+			t.Fatal(err)
+		}
+		hook := config.Webhooks[0]
+		if hook.ClientConfig.Service.Namespace != "infra" || *hook.ClientConfig.Service.Path != "/validate" || string(hook.ClientConfig.CABundle) != "ca" {
+			t.Errorf("unexpected client config %+v", hook.ClientConfig)
+		}
+		if *hook.FailurePolicy != admissionregistrationv1.Fail || *hook.TimeoutSeconds != 10 {
+			t.Errorf("failurePolicy %s, timeoutSeconds %d, want Fail and 10", *hook.FailurePolicy, *hook.TimeoutSeconds)
+		}
+	}
+	want := []string{"ConfigMap", "Service", "Deployment", "ValidatingWebhookConfiguration", "MutatingWebhookConfiguration"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got kinds %v, want %v", kinds, want)
+	}
+
+	for _, tt := range []struct {
+		timeoutSeconds int
+		failurePolicy  string
+	}{{0, "Ignore"}, {31, "Ignore"}, {10, "Retry"}} {
+		opts.timeoutSeconds, opts.failurePolicy = tt.timeoutSeconds, tt.failurePolicy
+		if _, err := buildManifests(opts, defaultPolicy()); err == nil {
+			t.Errorf("timeoutSeconds %d, failurePolicy %s: no error", tt.timeoutSeconds, tt.failurePolicy)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The metrics are written in the Prometheus text exposition format. The
+// handful the webhook needs are implemented here rather than pulling in the
+// Prometheus client and its dependencies.
+
+var (
+	admissionRequests = newCounterVec("k8s_ac_admission_requests_total",
+		"Admission requests by endpoint, kind, namespace, operation and outcome.",
+		"path", "kind", "namespace", "operation", "outcome")
+	admissionDuration = newHistogramVec("k8s_ac_admission_duration_seconds",
+		"Time taken to answer admission requests.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		"path")
+	patchSize = newHistogramVec("k8s_ac_patch_bytes",
+		"Size of the JSON patches returned by /mutate.",
+		[]float64{64, 128, 256, 512, 1024, 2048, 4096, 8192},
+		"kind")
+)
+
+// Request outcomes.
+const (
+	outcomeAllowed = "allowed"
+	outcomeDenied  = "denied"
+	outcomeError   = "error"
+	outcomePatched = "patched"
+)
+
+// collector is a metric family that can write itself.
+type collector interface {
+	write(w io.Writer)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// inc increments the counter for the given label values.
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[labelKey(values)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// observe records v for the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value, and labels, are read when scraped.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	// value returns the label values and the current value, ok is false
+	// when there is nothing to report.
+	value func() (values []string, v float64, ok bool)
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	if values, v, ok := g.value(); ok {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelKey(values), "", ""), formatFloat(v))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders the label set stored under key, plus an optional
+// extra label such as a histogram's le.
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler serves the webhook metrics together with the state of the
+// policy and certificate.
+func metricsHandler(policies *policyStore, certs *keyPairReloader) http.HandlerFunc {
+	collectors := []collector{
+		admissionRequests,
+		admissionDuration,
+		patchSize,
+		&gaugeFunc{
+			name:   "k8s_ac_policy_info",
+			help:   "The policy revision in use.",
+			labels: []string{"revision", "source"},
+			value: func() ([]string, float64, bool) {
+				rev := policies.Load()
+				return []string{rev.revision, rev.source}, 1, true
+			},
+		},
+		&gaugeFunc{
+			name: "k8s_ac_policy_reload_error",
+			help: "Whether the last policy reload failed.",
+			value: func() ([]string, float64, bool) {
+				return nil, boolValue(policies.lastError() != nil), true
+			},
+		},
+		&gaugeFunc{
+			name: "k8s_ac_certificate_expiry_timestamp_seconds",
+			help: "Expiry of the serving certificate in seconds since the epoch.",
+			value: func() ([]string, float64, bool) {
+				leaf := certs.leaf()
+				if leaf == nil {
+					return nil, 0, false
+				}
+				return nil, float64(leaf.NotAfter.Unix()), true
+			},
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range collectors {
+			c.write(w)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// observeRequest records the outcome and latency of an admission request.
+// req and resp are nil when the review could not be decoded.
+func observeRequest(path string, req *v1beta1.AdmissionRequest, resp *admissionResponse, start time.Time) {
+	var kind, namespace, operation string
+	if req != nil {
+		kind, namespace, operation = req.Kind.Kind, req.Namespace, string(req.Operation)
+	}
+	admissionRequests.inc(path, kind, namespace, operation, responseOutcome(resp))
+	admissionDuration.observe(time.Since(start).Seconds(), path)
+	if resp != nil && len(resp.Patch) > 0 {
+		patchSize.observe(float64(len(resp.Patch)), kind)
+	}
+}
+
+// responseOutcome classifies a response for the request counter.
+func responseOutcome(resp *admissionResponse) string {
+	switch {
+	case resp == nil:
+		return outcomeError
+	case resp.Allowed && len(resp.Patch) > 0:
+		return outcomePatched
+	case resp.Allowed:
+		return outcomeAllowed
+	case resp.Result != nil && resp.Result.Reason == metav1.StatusReasonForbidden:
+		return outcomeDenied
+	default:
+		return outcomeError
+	}
+}
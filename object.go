@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podTemplatePaths are the locations workload kinds embed a pod template
+// at: spec.template for Deployment, StatefulSet, DaemonSet, ReplicaSet and
+// Job, spec.jobTemplate.spec.template for CronJob.
+var podTemplatePaths = [][]string{
+	{"spec", "template"},
+	{"spec", "jobTemplate", "spec", "template"},
+}
+
+// admissionObject is a request object of any kind, decoded only as far as
+// the webhook needs: its metadata and any embedded pod templates.
+type admissionObject struct {
+	meta      metav1.ObjectMeta
+	templates []podTemplate
+	// selector is the label selector of a workload with a spec.template,
+	// nil for kinds without one.
+	selector *selectorLabels
+	// pod is the spec of a Pod, or the ephemeral containers of an
+	// EphemeralContainers object, nil for other kinds.
+	pod *podSpec
+}
+
+// podSpec is a pod spec within the request object.
+type podSpec struct {
+	// path is the JSON pointer of the spec within the object.
+	path string
+	spec v1.PodSpec
+	// seccomp holds the seccomp profiles of the spec.
+	seccomp seccompSpec
+	// labels and annotations are those of the pod or pod template.
+	labels      map[string]string
+	annotations map[string]string
+	// partial is set when only the ephemeral containers of the pod are
+	// known, the pod level fields are not.
+	partial bool
+}
+
+// seccompProfile is the securityContext.seccompProfile field, added in
+// Kubernetes 1.19 after the vendored API types.
+type seccompProfile struct {
+	Type             string `json:"type"`
+	LocalhostProfile string `json:"localhostProfile,omitempty"`
+}
+
+// seccompSpec are the seccomp profiles of a pod spec and its containers.
+type seccompSpec struct {
+	SecurityContext struct {
+		SeccompProfile *seccompProfile `json:"seccompProfile"`
+	} `json:"securityContext"`
+	InitContainers      []seccompContainer `json:"initContainers"`
+	Containers          []seccompContainer `json:"containers"`
+	EphemeralContainers []seccompContainer `json:"ephemeralContainers"`
+}
+
+type seccompContainer struct {
+	SecurityContext struct {
+		SeccompProfile *seccompProfile `json:"seccompProfile"`
+	} `json:"securityContext"`
+}
+
+// podTemplate is a pod template embedded in a workload.
+type podTemplate struct {
+	// path is the JSON pointer of the template within the object.
+	path        string
+	hasMetadata bool
+	template    v1.PodTemplateSpec
+	seccomp     seccompSpec
+}
+
+// selectorLabels are the equality based labels of a workload selector.
+type selectorLabels struct {
+	// path is the JSON pointer of the labels map, spec.selector.matchLabels
+	// for LabelSelectors and spec.selector for ReplicationControllers.
+	path   string
+	labels map[string]string
+}
+
+func decodeObject(kind string, raw []byte) (*admissionObject, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	partial := struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(raw, &partial); err != nil {
+		return nil, err
+	}
+
+	obj := &admissionObject{meta: partial.Metadata}
+	for _, path := range podTemplatePaths {
+		value, ok := nestedField(fields, path...)
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := podTemplate{path: "/" + strings.Join(path, "/")}
+		seccomp := struct {
+			Spec seccompSpec `json:"spec"`
+		}{}
+		if err := json.Unmarshal(data, &tmpl.template); err == nil {
+			err = json.Unmarshal(data, &seccomp)
+		}
+		if err != nil {
+			// custom resources may use the same field names for other things
+			log.Debug("ignoring field, not a pod template", "field", fieldPath(tmpl.path), "error", err)
+			continue
+		}
+		tmpl.seccomp = seccomp.Spec
+		_, tmpl.hasMetadata = nestedField(fields, append(path, "metadata")...)
+		obj.templates = append(obj.templates, tmpl)
+	}
+	if len(obj.templates) > 0 && obj.templates[0].path == "/spec/template" {
+		obj.selector = decodeSelector(fields)
+	}
+
+	switch kind {
+	case "Pod":
+		pod := struct {
+			Spec v1.PodSpec `json:"spec"`
+		}{}
+		seccomp := struct {
+			Spec seccompSpec `json:"spec"`
+		}{}
+		if err := json.Unmarshal(raw, &pod); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &seccomp); err != nil {
+			return nil, err
+		}
+		obj.pod = &podSpec{
+			path:        "/spec",
+			spec:        pod.Spec,
+			seccomp:     seccomp.Spec,
+			labels:      obj.meta.Labels,
+			annotations: obj.meta.Annotations,
+		}
+	case "EphemeralContainers":
+		// the object of the pods/ephemeralcontainers subresource before
+		// Kubernetes 1.22, later versions send the whole Pod
+		ec := struct {
+			EphemeralContainers []v1.EphemeralContainer `json:"ephemeralContainers"`
+		}{}
+		seccomp := seccompSpec{}
+		if err := json.Unmarshal(raw, &ec); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &seccomp); err != nil {
+			return nil, err
+		}
+		obj.pod = &podSpec{
+			spec:    v1.PodSpec{EphemeralContainers: ec.EphemeralContainers},
+			seccomp: seccompSpec{EphemeralContainers: seccomp.EphemeralContainers},
+			partial: true,
+		}
+	}
+	return obj, nil
+}
+
+// podSpecs returns the spec of a Pod or the specs of the pod templates
+// embedded in a workload.
+func (obj *admissionObject) podSpecs() []podSpec {
+	if obj.pod != nil {
+		return []podSpec{*obj.pod}
+	}
+	specs := make([]podSpec, 0, len(obj.templates))
+	for _, t := range obj.templates {
+		specs = append(specs, podSpec{
+			path:        t.path + "/spec",
+			spec:        t.template.Spec,
+			seccomp:     t.seccomp,
+			labels:      t.template.Labels,
+			annotations: t.template.Annotations,
+		})
+	}
+	return specs
+}
+
+// containerRef is a container of a pod spec.
+type containerRef struct {
+	// path is the dotted path of the container within the object, such as
+	// spec.template.spec.initContainers[0].
+	path string
+	// pointer is the JSON pointer of the container.
+	pointer string
+	// ephemeral containers can only be changed through the
+	// pods/ephemeralcontainers subresource.
+	ephemeral bool
+	container v1.Container
+	// seccomp is the container's securityContext.seccompProfile.
+	seccomp *seccompProfile
+}
+
+func (c containerRef) String() string {
+	return fmt.Sprintf("%s (%s)", c.path, c.container.Name)
+}
+
+// containers returns the containers, init containers and ephemeral
+// containers of the spec.
+func (s podSpec) containers() []containerRef {
+	prefix := fieldPath(s.path)
+	if prefix != "" {
+		prefix += "."
+	}
+	var out []containerRef
+	add := func(field string, i int, c v1.Container, seccomp []seccompContainer) {
+		ref := containerRef{
+			path:      fmt.Sprintf("%s%s[%d]", prefix, field, i),
+			pointer:   fmt.Sprintf("%s/%s/%d", s.path, field, i),
+			ephemeral: field == "ephemeralContainers",
+			container: c,
+		}
+		if i < len(seccomp) {
+			ref.seccomp = seccomp[i].SecurityContext.SeccompProfile
+		}
+		out = append(out, ref)
+	}
+	for i, c := range s.spec.InitContainers {
+		add("initContainers", i, c, s.seccomp.InitContainers)
+	}
+	for i, c := range s.spec.Containers {
+		add("containers", i, c, s.seccomp.Containers)
+	}
+	for i, c := range s.spec.EphemeralContainers {
+		add("ephemeralContainers", i, v1.Container(c.EphemeralContainerCommon), s.seccomp.EphemeralContainers)
+	}
+	return out
+}
+
+// decodeSelector returns the labels of spec.selector, or nil when the
+// object has none or it cannot be interpreted.
+func decodeSelector(fields map[string]interface{}) *selectorLabels {
+	value, ok := nestedField(fields, "spec", "selector")
+	if !ok {
+		return nil
+	}
+	sel, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	_, hasLabels := sel["matchLabels"]
+	_, hasExpressions := sel["matchExpressions"]
+	if hasLabels || hasExpressions {
+		labels := metav1.LabelSelector{}
+		if !remarshal(sel, &labels) {
+			return nil
+		}
+		return &selectorLabels{path: "/spec/selector/matchLabels", labels: labels.MatchLabels}
+	}
+	labels := map[string]string{}
+	if !remarshal(sel, &labels) {
+		return nil
+	}
+	return &selectorLabels{path: "/spec/selector", labels: labels}
+}
+
+// remarshal converts decoded JSON into a typed value.
+func remarshal(in interface{}, out interface{}) bool {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, out) == nil
+}
+
+// fieldPath turns a JSON pointer into the dotted form used in messages.
+func fieldPath(pointer string) string {
+	return strings.Replace(strings.TrimPrefix(pointer, "/"), "/", ".", -1)
+}
+
+// nestedField returns the value at path in a decoded JSON object.
+func nestedField(obj map[string]interface{}, path ...string) (interface{}, bool) {
+	var cur interface{} = obj
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok || cur == nil {
+			return nil, false
+		}
+	}
+	return cur, true
+}
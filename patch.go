@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+)
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// escapePointer escapes a map key for use as an RFC 6901 JSON pointer token.
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// updLabel returns the operations adding the keys of added that are missing
+// from the labels map at path. target is the current map and nil when the
+// map does not exist, in which case it is created in a single operation.
+// Existing labels are never touched.
+func updLabel(path string, target map[string]string, added map[string]string) (patch []patchOperation) {
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		if _, ok := target[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if target == nil {
+		values := make(map[string]string, len(keys))
+		for _, key := range keys {
+			values[key] = added[key]
+		}
+		return []patchOperation{{Op: "add", Path: path, Value: values}}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path + "/" + escapePointer(key),
+			Value: added[key],
+		})
+	}
+	return patch
+}
+
+// createPatch adds the policy's default labels to the object, to its pod
+// templates unless they are immutable and, on CREATE, to the selector
+// matching those templates. In templates that are not immutable it fills in
+// default container resources, in pods only on CREATE, and points container
+// images at their mirror, in pods only those the request changes. notes
+// explains changes that were deliberately left out.
+func createPatch(req *v1beta1.AdmissionRequest, obj *admissionObject, policy *Policy) (patch []patchOperation, notes []string) {
+	defaults := policy.defaults(req.Kind.Kind, req.Namespace)
+	if reqMutation(obj.meta.Labels, defaults) {
+		patch = append(patch, updLabel("/metadata/labels", obj.meta.Labels, defaults)...)
+	}
+
+	podDefaults := policy.defaults("Pod", req.Namespace)
+	for _, t := range obj.templates {
+		if !reqMutation(t.template.Labels, podDefaults) {
+			continue
+		}
+		if immutableTemplate(req) {
+			var keys []string
+			for key := range podDefaults {
+				if _, ok := t.template.Labels[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			notes = append(notes, fmt.Sprintf("not adding %s to %s on %s, the pod template of a Job is immutable",
+				strings.Join(keys, ", "), fieldPath(t.path+"/metadata/labels"), req.Operation))
+			continue
+		}
+		if !t.hasMetadata {
+			patch = append(patch, patchOperation{Op: "add", Path: t.path + "/metadata", Value: map[string]interface{}{}})
+		}
+		patch = append(patch, updLabel(t.path+"/metadata/labels", t.template.Labels, podDefaults)...)
+	}
+	if !immutableTemplate(req) {
+		// a pod's container resources are immutable
+		if obj.pod == nil || req.Operation == v1beta1.Create {
+			patch = append(patch, defaultResources(req.Namespace, obj, policy, podDefaults)...)
+		}
+		patch = append(patch, mirrorImages(req.Namespace, obj, policy, false, unchangedImages(req, obj))...)
+	}
+
+	if obj.selector == nil {
+		return patch, notes
+	}
+	missing := make(map[string]string)
+	for _, key := range policy.selectorKeys(req.Namespace) {
+		if _, ok := obj.selector.labels[key]; ok {
+			continue
+		}
+		// the selector has to keep matching the template
+		value, ok := obj.templates[0].template.Labels[key]
+		if !ok {
+			value = podDefaults[key]
+		}
+		missing[key] = value
+	}
+	if len(missing) == 0 {
+		return patch, notes
+	}
+	if req.Operation != v1beta1.Create {
+		keys := make([]string, 0, len(missing))
+		for key := range missing {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		notes = append(notes, fmt.Sprintf("not adding %s to %s on %s, selectors are immutable and only extended on CREATE",
+			strings.Join(keys, ", "), fieldPath(obj.selector.path), req.Operation))
+		return patch, notes
+	}
+	patch = append(patch, updLabel(obj.selector.path, obj.selector.labels, missing)...)
+	return patch, notes
+}
+
+// immutableTemplate reports whether req may not change the pod template of
+// its object: the spec.template of a Job cannot be updated.
+func immutableTemplate(req *v1beta1.AdmissionRequest) bool {
+	return req.Operation != v1beta1.Create && req.Kind.Group == "batch" && req.Kind.Kind == "Job"
+}
+
+// defaultResources returns the operations adding the default requests and
+// limits that containers do not set. Defaults are chosen by the pod's labels
+// including the default labels added by the same patch.
+func defaultResources(namespace string, obj *admissionObject, policy *Policy, podDefaults map[string]string) (patch []patchOperation) {
+	if len(policy.Resources) == 0 {
+		return nil
+	}
+	for _, s := range obj.podSpecs() {
+		labels := make(map[string]string, len(s.labels)+len(podDefaults))
+		for key, value := range podDefaults {
+			labels[key] = value
+		}
+		for key, value := range s.labels {
+			labels[key] = value
+		}
+		requests, limits := policy.resourceDefaults(namespace, labels)
+		if len(requests) == 0 && len(limits) == 0 {
+			continue
+		}
+		for _, c := range s.containers() {
+			if c.ephemeral {
+				continue
+			}
+			res := c.container.Resources
+			// Kubernetes sets missing requests to the limit, and a default
+			// limit below the request would make the pod invalid
+			addRequests, addLimits := v1.ResourceList{}, v1.ResourceList{}
+			for name, q := range requests {
+				if _, ok := res.Limits[name]; !ok {
+					addRequests[name] = q
+				}
+			}
+			for name, q := range limits {
+				if request, ok := res.Requests[name]; !ok || q.Cmp(request) >= 0 {
+					addLimits[name] = q
+				}
+			}
+			if res.Requests == nil && res.Limits == nil {
+				// the resources field may be missing altogether, replace it
+				value := map[string]map[string]string{}
+				if len(addRequests) > 0 {
+					value["requests"] = quantityStrings(addRequests)
+				}
+				if len(addLimits) > 0 {
+					value["limits"] = quantityStrings(addLimits)
+				}
+				if len(value) > 0 {
+					patch = append(patch, patchOperation{Op: "add", Path: c.pointer + "/resources", Value: value})
+				}
+				continue
+			}
+			patch = append(patch, updLabel(c.pointer+"/resources/requests", quantityStrings(res.Requests), quantityStrings(addRequests))...)
+			patch = append(patch, updLabel(c.pointer+"/resources/limits", quantityStrings(res.Limits), quantityStrings(addLimits))...)
+		}
+	}
+	return patch
+}
+
+// unchangedImages returns the images of the containers of the Pod a Pod
+// UPDATE replaces, by container name. Only the images the update changes are
+// mirrored, the others may predate the mirror rules. It returns nil for other
+// requests, pod templates are mirrored in full.
+func unchangedImages(req *v1beta1.AdmissionRequest, obj *admissionObject) map[string]string {
+	if obj.pod == nil || req.Operation != v1beta1.Update || len(req.OldObject.Raw) == 0 {
+		return nil
+	}
+	old, err := decodeObject(req.Kind.Kind, req.OldObject.Raw)
+	if err != nil || old.pod == nil {
+		return nil
+	}
+	images := make(map[string]string)
+	for _, c := range old.pod.containers() {
+		images[c.container.Name] = c.container.Image
+	}
+	return images
+}
+
+// quantityStrings returns list as a map of strings, nil for a nil list.
+func quantityStrings(list v1.ResourceList) map[string]string {
+	if list == nil {
+		return nil
+	}
+	out := make(map[string]string, len(list))
+	for name, q := range list {
+		out[string(name)] = q.String()
+	}
+	return out
+}
+
+// mirrorImages returns the operations pointing the images of the object's
+// containers, or only of its ephemeral containers, at their mirror. Mirrored
+// images are not rewritten again, so patching an object that was already
+// patched changes nothing. Containers whose image is listed in unchanged
+// under their name are left alone.
+func mirrorImages(namespace string, obj *admissionObject, policy *Policy, ephemeral bool, unchanged map[string]string) (patch []patchOperation) {
+	if len(policy.Mirrors) == 0 {
+		return nil
+	}
+	for _, s := range obj.podSpecs() {
+		for _, c := range s.containers() {
+			if c.ephemeral != ephemeral {
+				continue
+			}
+			if image, ok := unchanged[c.container.Name]; ok && image == c.container.Image {
+				continue
+			}
+			if image, ok := policy.mirror(namespace, c.container.Image); ok {
+				patch = append(patch, patchOperation{Op: "replace", Path: c.pointer + "/image", Value: image})
+			}
+		}
+	}
+	return patch
+}
+
+// applyPatch applies an RFC 6902 JSON patch to doc.
+func applyPatch(doc []byte, patch []byte) ([]byte, error) {
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(doc)
+}
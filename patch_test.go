@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEscapePointer(t *testing.T) {
+	tests := map[string]string{
+		"team":                   "team",
+		"app.kubernetes.io/team": "app.kubernetes.io~1team",
+		"a~b":                    "a~0b",
+		"~/":                     "~0~1",
+	}
+	for in, want := range tests {
+		if got := escapePointer(in); got != want {
+			t.Errorf("escapePointer(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUpdLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		target map[string]string
+		added  map[string]string
+		want   []patchOperation
+	}{
+		{
+			name:  "creates missing map",
+			added: map[string]string{"team": "ops"},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/labels", Value: map[string]string{"team": "ops"}},
+			},
+		},
+		{
+			name:   "adds missing keys to existing map",
+			target: map[string]string{"app": "web"},
+			added:  map[string]string{"team": "ops", "app.kubernetes.io/part-of": "shop"},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/app.kubernetes.io~1part-of", Value: "shop"},
+				{Op: "add", Path: "/metadata/labels/team", Value: "ops"},
+			},
+		},
+		{
+			name:   "adds to empty map",
+			target: map[string]string{},
+			added:  map[string]string{"team": "ops"},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/labels/team", Value: "ops"},
+			},
+		},
+		{
+			name:   "keeps existing values",
+			target: map[string]string{"team": "dev", "app": "web"},
+			added:  map[string]string{"team": "ops"},
+		},
+		{
+			name:   "keeps existing empty values",
+			target: map[string]string{"team": ""},
+			added:  map[string]string{"team": "ops"},
+		},
+		{
+			name: "nothing to add",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := updLabel("/metadata/labels", tt.target, tt.added)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("updLabel() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePatch(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+labels:
+  - name: team
+    key: app.kubernetes.io/team
+    default: ops
+    selector: true
+  - name: cost-center
+    key: cost-center
+    kinds: ["Deployment"]
+    default: "42"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		kind      string
+		operation v1beta1.Operation
+		object    string
+		want      string
+		wantNotes int
+	}{
+		{
+			name:   "pod without labels",
+			kind:   "Pod",
+			object: `{"metadata":{"name":"p"}}`,
+			want:   `{"metadata":{"name":"p","labels":{"app.kubernetes.io/team":"ops"}}}`,
+		},
+		{
+			name:   "pod keeps existing labels",
+			kind:   "Pod",
+			object: `{"metadata":{"name":"p","labels":{"app":"web"}}}`,
+			want:   `{"metadata":{"name":"p","labels":{"app":"web","app.kubernetes.io/team":"ops"}}}`,
+		},
+		{
+			name:   "pod already labelled",
+			kind:   "Pod",
+			object: `{"metadata":{"name":"p","labels":{"app.kubernetes.io/team":"dev"}}}`,
+		},
+		{
+			name:      "deployment create extends template and selector",
+			kind:      "Deployment",
+			operation: v1beta1.Create,
+			object: `{"metadata":{"name":"d","labels":{"app":"web"}},"spec":{
+				"selector":{"matchLabels":{"app":"web"}},
+				"template":{"metadata":{"labels":{"app":"web"}},"spec":{}}}}`,
+			want: `{"metadata":{"name":"d","labels":{"app":"web","app.kubernetes.io/team":"ops","cost-center":"42"}},"spec":{
+				"selector":{"matchLabels":{"app":"web","app.kubernetes.io/team":"ops"}},
+				"template":{"metadata":{"labels":{"app":"web","app.kubernetes.io/team":"ops"}},"spec":{}}}}`,
+		},
+		{
+			name:      "deployment update leaves selector alone",
+			kind:      "Deployment",
+			operation: v1beta1.Update,
+			object: `{"metadata":{"name":"d","labels":{"app":"web","cost-center":"1"}},"spec":{
+				"selector":{"matchLabels":{"app":"web"}},
+				"template":{"metadata":{"labels":{"app":"web"}},"spec":{}}}}`,
+			want: `{"metadata":{"name":"d","labels":{"app":"web","app.kubernetes.io/team":"ops","cost-center":"1"}},"spec":{
+				"selector":{"matchLabels":{"app":"web"}},
+				"template":{"metadata":{"labels":{"app":"web","app.kubernetes.io/team":"ops"}},"spec":{}}}}`,
+			wantNotes: 1,
+		},
+		{
+			name:      "selector keeps matching a template value",
+			kind:      "StatefulSet",
+			operation: v1beta1.Create,
+			object: `{"metadata":{"name":"s","labels":{"app.kubernetes.io/team":"ops"}},"spec":{
+				"selector":{"matchExpressions":[{"key":"app","operator":"Exists"}]},
+				"template":{"metadata":{"labels":{"app":"db","app.kubernetes.io/team":"dba"}},"spec":{}}}}`,
+			want: `{"metadata":{"name":"s","labels":{"app.kubernetes.io/team":"ops"}},"spec":{
+				"selector":{"matchExpressions":[{"key":"app","operator":"Exists"}],"matchLabels":{"app.kubernetes.io/team":"dba"}},
+				"template":{"metadata":{"labels":{"app":"db","app.kubernetes.io/team":"dba"}},"spec":{}}}}`,
+		},
+		{
+			name:      "cronjob template without metadata",
+			kind:      "CronJob",
+			operation: v1beta1.Create,
+			object:    `{"metadata":{"name":"c"},"spec":{"jobTemplate":{"spec":{"template":{"spec":{}}}}}}`,
+			want: `{"metadata":{"name":"c","labels":{"app.kubernetes.io/team":"ops"}},"spec":{"jobTemplate":{"spec":{
+				"template":{"metadata":{"labels":{"app.kubernetes.io/team":"ops"}},"spec":{}}}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := decodeObject(tt.kind, []byte(tt.object))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &v1beta1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Kind: tt.kind},
+				Namespace: "default",
+				Operation: tt.operation,
+			}
+			patch, notes := createPatch(req, obj, policy)
+			if len(notes) != tt.wantNotes {
+				t.Errorf("got notes %q, want %d", notes, tt.wantNotes)
+			}
+			if tt.want == "" {
+				if len(patch) != 0 {
+					t.Fatalf("expected no patch, got %+v", patch)
+				}
+				return
+			}
+
+			data, err := json.Marshal(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyPatch([]byte(tt.object), data)
+			if err != nil {
+				t.Fatalf("applying %s: %v", data, err)
+			}
+			var gotObj, wantObj interface{}
+			json.Unmarshal(got, &gotObj)
+			if err := json.Unmarshal([]byte(tt.want), &wantObj); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotObj, wantObj) {
+				t.Errorf("patched object\n%s\nwant\n%s\npatch %s", got, tt.want, data)
+			}
+		})
+	}
+}
+
+func TestMirrorImagesIsIdempotent(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+labels: []
+mirrors:
+  - name: acme
+    from: gcr.io/acme
+    to: mirror.example.com/acme
+  - name: dockerhub
+    from: docker.io
+    to: mirror.example.com/dockerhub
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := []byte(`{"metadata":{"name":"p"},"spec":{"initContainers":[{"name":"init","image":"busybox"}],"containers":[
+		{"name":"app","image":"gcr.io/acme/web:1.4@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		{"name":"db","image":"postgres:13"},
+		{"name":"other","image":"quay.io/other/tool:2"}]}}`)
+	want := []string{
+		"mirror.example.com/dockerhub/library/busybox",
+		"mirror.example.com/acme/web:1.4@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"mirror.example.com/dockerhub/library/postgres:13",
+		"quay.io/other/tool:2",
+	}
+	req := &v1beta1.AdmissionRequest{Kind: metav1.GroupVersionKind{Kind: "Pod"}, Namespace: "default", Operation: v1beta1.Create}
+	mirror := func(object []byte) ([]byte, []patchOperation) {
+		obj, err := decodeObject("Pod", object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, _ := createPatch(req, obj, policy)
+		data, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := applyPatch(object, data)
+		if err != nil {
+			t.Fatalf("applying %s: %v", data, err)
+		}
+		return patched, patch
+	}
+
+	mirrored, _ := mirror(object)
+	obj, err := decodeObject("Pod", mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range obj.pod.containers() {
+		got = append(got, c.container.Image)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mirrored images = %q, want %q", got, want)
+	}
+	if _, patch := mirror(mirrored); len(patch) != 0 {
+		t.Errorf("patching the mirrored object again gave %+v", patch)
+	}
+}
+
+func TestHardenSecurityContext(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+labels: []
+securityDefaults:
+  - name: hardened
+    namespaces: ["shop"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := []byte(`{"metadata":{"name":"p","annotations":{"k8s-ac/security-defaults-opt-out":"runAsNonRoot"}},
+		"spec":{"securityContext":{"seccompProfile":{"type":"Localhost","localhostProfile":"p.json"}},"containers":[
+		{"name":"app","image":"app"},
+		{"name":"tool","image":"tool","securityContext":{"readOnlyRootFilesystem":false}}]}}`)
+	harden := func(namespace string, op v1beta1.Operation, object []byte) ([]byte, []patchOperation, []securityOptOut) {
+		obj, err := decodeObject("Pod", object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &v1beta1.AdmissionRequest{Kind: metav1.GroupVersionKind{Kind: "Pod"}, Namespace: namespace, Operation: op}
+		patch, optOuts, notes := hardenSecurityContext(req, obj, policy)
+		if len(notes) > 0 {
+			t.Errorf("unexpected notes %q", notes)
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := applyPatch(object, data)
+		if err != nil {
+			t.Fatalf("applying %s: %v", data, err)
+		}
+		return patched, patch, optOuts
+	}
+
+	hardened, _, optOuts := harden("shop", v1beta1.Create, object)
+	want := `{"metadata":{"name":"p","annotations":{"k8s-ac/security-defaults-opt-out":"runAsNonRoot"}},
+		"spec":{"securityContext":{"seccompProfile":{"type":"Localhost","localhostProfile":"p.json"}},"containers":[
+		{"name":"app","image":"app","securityContext":{"readOnlyRootFilesystem":true,"allowPrivilegeEscalation":false,"capabilities":{"drop":["ALL"]}}},
+		{"name":"tool","image":"tool","securityContext":{"readOnlyRootFilesystem":false,"allowPrivilegeEscalation":false,"capabilities":{"drop":["ALL"]}}}]}}`
+	if !jsonEqual(hardened, []byte(want)) {
+		t.Errorf("hardened pod\n%s\nwant\n%s", hardened, want)
+	}
+	wantOptOuts := []securityOptOut{{Rule: "hardened", Path: "spec", Fields: []string{"runAsNonRoot"}}}
+	if !reflect.DeepEqual(optOuts, wantOptOuts) {
+		t.Errorf("opt-outs = %+v, want %+v", optOuts, wantOptOuts)
+	}
+	if _, patch, _ := harden("shop", v1beta1.Create, hardened); len(patch) > 0 {
+		t.Errorf("hardening twice patched %+v", patch)
+	}
+	// container security contexts are immutable once the pod exists
+	if _, patch, _ := harden("shop", v1beta1.Update, object); len(patch) > 0 {
+		t.Errorf("update patched %+v", patch)
+	}
+	if _, patch, _ := harden("default", v1beta1.Create, object); len(patch) > 0 {
+		t.Errorf("namespace without a rule patched %+v", patch)
+	}
+}
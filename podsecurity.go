@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The values the Pod Security Standards allow, as of Kubernetes 1.25.
+var (
+	baselineCapabilities = []string{
+		"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+		"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+	}
+	restrictedCapabilities = []string{"NET_BIND_SERVICE"}
+	safeSysctls            = []string{
+		"kernel.shm_rmid_forced", "net.ipv4.ip_local_port_range", "net.ipv4.ip_unprivileged_port_start",
+		"net.ipv4.tcp_syncookies", "net.ipv4.ping_group_range",
+	}
+	seLinuxTypes = []string{"", "container_t", "container_init_t", "container_kvm_t"}
+)
+
+const (
+	appArmorAnnotationPrefix       = "container.apparmor.security.beta.kubernetes.io/"
+	seccompPodAnnotation           = "seccomp.security.alpha.kubernetes.io/pod"
+	seccompContainerAnnotationPref = "container.seccomp.security.alpha.kubernetes.io/"
+)
+
+// podSecurityRule returns the rule for namespace, nil when there is none.
+func (p *Policy) podSecurityRule(namespace string) *PodSecurityRule {
+	var fallback *PodSecurityRule
+	for i := range p.PodSecurity {
+		r := &p.PodSecurity[i]
+		if contains(r.Namespaces, namespace) {
+			return r
+		}
+		if len(r.Namespaces) == 0 && fallback == nil {
+			fallback = r
+		}
+	}
+	return fallback
+}
+
+// matchingPodSecurityRules returns the name of the pod security rule that
+// applies to pods in namespace.
+func (p *Policy) matchingPodSecurityRules(namespace string) []string {
+	if r := p.podSecurityRule(namespace); r != nil {
+		return []string{r.Name}
+	}
+	return nil
+}
+
+// podSecurityViolations returns one entry per control of the namespace's
+// level that a spec violates, so every problem is reported at once.
+func (p *Policy) podSecurityViolations(namespace string, specs []podSpec) []violation {
+	r := p.podSecurityRule(namespace)
+	if r == nil || r.Level == LevelPrivileged {
+		return nil
+	}
+	mode := r.Mode
+	if mode == "" {
+		mode = ModeEnforce
+	}
+	var out []violation
+	for _, s := range specs {
+		for _, msg := range checkPodSecurity(r.Level, s) {
+			out = append(out, violation{r.Name, mode, msg})
+		}
+	}
+	return out
+}
+
+// podSpecUnchanged reports whether req updates a Pod without changing its
+// spec, such as a label or annotation change. Those are not checked against
+// the pod security level, so a pod admitted before a stricter level applied
+// can still be relabelled.
+func podSpecUnchanged(req *v1beta1.AdmissionRequest, obj *admissionObject) bool {
+	if obj.pod == nil || req.Operation != v1beta1.Update || len(req.OldObject.Raw) == 0 {
+		return false
+	}
+	old, err := decodeObject(req.Kind.Kind, req.OldObject.Raw)
+	if err != nil || old.pod == nil {
+		return false
+	}
+	return reflect.DeepEqual(old.pod.spec, obj.pod.spec) && reflect.DeepEqual(old.pod.seccomp, obj.pod.seccomp)
+}
+
+// checkPodSecurity returns a message per control of level the spec violates.
+func checkPodSecurity(level PodSecurityLevel, s podSpec) []string {
+	var msgs []string
+	pod := fieldPath(s.path)
+	fail := func(where, control, format string, args ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf("%s: %s: %s", where, control, fmt.Sprintf(format, args...)))
+	}
+	psc := s.spec.SecurityContext
+	if psc == nil {
+		psc = &v1.PodSecurityContext{}
+	}
+	containers := s.containers()
+	allowedCapabilities := baselineCapabilities
+	if level == LevelRestricted {
+		allowedCapabilities = restrictedCapabilities
+	}
+
+	// baseline, pod level
+	if !s.partial {
+		var hostNamespaces []string
+		if s.spec.HostNetwork {
+			hostNamespaces = append(hostNamespaces, "hostNetwork")
+		}
+		if s.spec.HostPID {
+			hostNamespaces = append(hostNamespaces, "hostPID")
+		}
+		if s.spec.HostIPC {
+			hostNamespaces = append(hostNamespaces, "hostIPC")
+		}
+		if len(hostNamespaces) > 0 {
+			fail(pod, "host namespaces", "%s must not be true", strings.Join(hostNamespaces, ", "))
+		}
+		var hostPaths []string
+		for _, vol := range s.spec.Volumes {
+			if vol.HostPath != nil {
+				hostPaths = append(hostPaths, vol.Name)
+			}
+		}
+		if len(hostPaths) > 0 {
+			fail(pod, "hostPath volumes", "volumes %s must not use hostPath", strings.Join(hostPaths, ", "))
+		}
+		var sysctls []string
+		for _, sc := range psc.Sysctls {
+			if !contains(safeSysctls, sc.Name) {
+				sysctls = append(sysctls, sc.Name)
+			}
+		}
+		if len(sysctls) > 0 {
+			fail(pod, "sysctls", "%s must not be set, only %s are allowed", strings.Join(sysctls, ", "), strings.Join(safeSysctls, ", "))
+		}
+		if msg := checkSELinux(psc.SELinuxOptions); msg != "" {
+			fail(pod, "SELinux", "securityContext.seLinuxOptions %s", msg)
+		}
+		if profileType(s.podSeccomp()) == "Unconfined" {
+			fail(pod, "seccomp", "the seccomp profile must not be Unconfined")
+		}
+		var appArmor []string
+		for key, value := range s.annotations {
+			if strings.HasPrefix(key, appArmorAnnotationPrefix) && value != "runtime/default" && !strings.HasPrefix(value, "localhost/") {
+				appArmor = append(appArmor, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+		if len(appArmor) > 0 {
+			sort.Strings(appArmor)
+			fail(pod, "AppArmor", "annotations %s must be runtime/default or localhost/*", strings.Join(appArmor, ", "))
+		}
+	}
+
+	// baseline, containers
+	for _, c := range containers {
+		sc := c.container.SecurityContext
+		if sc == nil {
+			sc = &v1.SecurityContext{}
+		}
+		if sc.Privileged != nil && *sc.Privileged {
+			fail(c.String(), "privileged containers", "securityContext.privileged must not be true")
+		}
+		if sc.Capabilities != nil {
+			if added := disallowed(sc.Capabilities.Add, allowedCapabilities); len(added) > 0 {
+				fail(c.String(), "capabilities", "adding %s is not allowed at level %s", strings.Join(added, ", "), level)
+			}
+		}
+		var hostPorts []string
+		for _, port := range c.container.Ports {
+			if port.HostPort != 0 {
+				hostPorts = append(hostPorts, fmt.Sprint(port.HostPort))
+			}
+		}
+		if len(hostPorts) > 0 {
+			fail(c.String(), "host ports", "hostPort %s must not be set", strings.Join(hostPorts, ", "))
+		}
+		if msg := checkSELinux(sc.SELinuxOptions); msg != "" {
+			fail(c.String(), "SELinux", "securityContext.seLinuxOptions %s", msg)
+		}
+		if sc.ProcMount != nil && *sc.ProcMount != v1.DefaultProcMount {
+			fail(c.String(), "/proc mount type", "securityContext.procMount must be Default, not %s", *sc.ProcMount)
+		}
+		if profileType(s.containerSeccomp(c)) == "Unconfined" {
+			fail(c.String(), "seccomp", "the seccomp profile must not be Unconfined")
+		}
+	}
+	if level != LevelRestricted {
+		return msgs
+	}
+
+	// restricted, pod level
+	if !s.partial {
+		var volumes []string
+		for _, vol := range s.spec.Volumes {
+			if !restrictedVolume(vol.VolumeSource) {
+				volumes = append(volumes, vol.Name)
+			}
+		}
+		if len(volumes) > 0 {
+			fail(pod, "volume types", "volumes %s must be configMap, csi, downwardAPI, emptyDir, persistentVolumeClaim, projected or secret", strings.Join(volumes, ", "))
+		}
+		if psc.RunAsUser != nil && *psc.RunAsUser == 0 {
+			fail(pod, "running as non-root user", "securityContext.runAsUser must not be 0")
+		}
+	}
+
+	// restricted, containers
+	podNonRoot := psc.RunAsNonRoot != nil && *psc.RunAsNonRoot
+	for _, c := range containers {
+		sc := c.container.SecurityContext
+		if sc == nil {
+			sc = &v1.SecurityContext{}
+		}
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			fail(c.String(), "privilege escalation", "securityContext.allowPrivilegeEscalation must be false")
+		}
+		switch {
+		case sc.RunAsNonRoot != nil && !*sc.RunAsNonRoot:
+			fail(c.String(), "running as non-root", "securityContext.runAsNonRoot must not be false")
+		case sc.RunAsNonRoot == nil && !podNonRoot && !s.partial:
+			fail(c.String(), "running as non-root", "securityContext.runAsNonRoot must be true on the container or the pod")
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+			fail(c.String(), "running as non-root user", "securityContext.runAsUser must not be 0")
+		}
+		// the pod's profile is not known for partial specs
+		if t := profileType(s.containerSeccomp(c)); (t != "" || !s.partial) && t != "RuntimeDefault" && t != "Localhost" {
+			fail(c.String(), "seccomp", "securityContext.seccompProfile.type must be RuntimeDefault or Localhost on the container or the pod")
+		}
+		var drop []string
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Drop {
+				drop = append(drop, string(capability))
+			}
+		}
+		if !contains(drop, "ALL") {
+			fail(c.String(), "capabilities", "securityContext.capabilities.drop must include ALL")
+		}
+	}
+	return msgs
+}
+
+// disallowed returns the capabilities of caps that are not in allowed.
+func disallowed(caps []v1.Capability, allowed []string) []string {
+	var out []string
+	for _, c := range caps {
+		if !contains(allowed, string(c)) {
+			out = append(out, string(c))
+		}
+	}
+	return out
+}
+
+func checkSELinux(opts *v1.SELinuxOptions) string {
+	if opts == nil {
+		return ""
+	}
+	var problems []string
+	if !contains(seLinuxTypes, opts.Type) {
+		problems = append(problems, fmt.Sprintf("type %s is not allowed", opts.Type))
+	}
+	if opts.User != "" {
+		problems = append(problems, "user must not be set")
+	}
+	if opts.Role != "" {
+		problems = append(problems, "role must not be set")
+	}
+	return strings.Join(problems, ", ")
+}
+
+// restrictedVolume reports whether the restricted level allows the source.
+func restrictedVolume(src v1.VolumeSource) bool {
+	return src.ConfigMap != nil || src.CSI != nil || src.DownwardAPI != nil || src.EmptyDir != nil ||
+		src.PersistentVolumeClaim != nil || src.Projected != nil || src.Secret != nil ||
+		src == (v1.VolumeSource{})
+}
+
+// podSeccomp returns the pod's seccomp profile, from the field or the
+// annotation that preceded it.
+func (s podSpec) podSeccomp() *seccompProfile {
+	if p := s.seccomp.SecurityContext.SeccompProfile; p != nil {
+		return p
+	}
+	return annotationSeccomp(s.annotations[seccompPodAnnotation])
+}
+
+// containerSeccomp returns the seccomp profile the container runs with, its
+// own or the pod's.
+func (s podSpec) containerSeccomp(c containerRef) *seccompProfile {
+	if c.seccomp != nil {
+		return c.seccomp
+	}
+	if p := annotationSeccomp(s.annotations[seccompContainerAnnotationPref+c.container.Name]); p != nil {
+		return p
+	}
+	return s.podSeccomp()
+}
+
+func annotationSeccomp(value string) *seccompProfile {
+	switch {
+	case value == "":
+		return nil
+	case value == "runtime/default" || value == "docker/default":
+		return &seccompProfile{Type: "RuntimeDefault"}
+	case strings.HasPrefix(value, "localhost/"):
+		return &seccompProfile{Type: "Localhost", LocalhostProfile: strings.TrimPrefix(value, "localhost/")}
+	}
+	return &seccompProfile{Type: "Unconfined"}
+}
+
+func profileType(p *seccompProfile) string {
+	if p == nil {
+		return ""
+	}
+	return p.Type
+}
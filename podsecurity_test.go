@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckPodSecurity(t *testing.T) {
+	// hardened passes the restricted level
+	const hardened = `"securityContext": {"runAsNonRoot": true, "seccompProfile": {"type": "RuntimeDefault"}},
+		"containers": [{"name": "app", "image": "app", "securityContext": {
+			"allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"], "add": ["NET_BIND_SERVICE"]}}}]`
+	tests := []struct {
+		name  string
+		kind  string
+		level PodSecurityLevel
+		obj   string
+		want  []string
+	}{
+		{
+			name:  "restricted pod",
+			kind:  "Pod",
+			level: LevelRestricted,
+			obj:   `{"spec": {` + hardened + `}}`,
+		},
+		{
+			name:  "legacy seccomp annotations",
+			kind:  "Pod",
+			level: LevelBaseline,
+			obj: `{"metadata": {"annotations": {
+					"seccomp.security.alpha.kubernetes.io/pod": "unconfined",
+					"container.seccomp.security.alpha.kubernetes.io/app": "runtime/default"}},
+				"spec": {"containers": [{"name": "app", "image": "app"}, {"name": "sidecar", "image": "sidecar"}]}}`,
+			want: []string{
+				"spec: seccomp: the seccomp profile must not be Unconfined",
+				"spec.containers[1] (sidecar): seccomp: the seccomp profile must not be Unconfined",
+			},
+		},
+		{
+			name:  "baseline allows what restricted does not",
+			kind:  "Pod",
+			level: LevelBaseline,
+			obj: `{"spec": {"securityContext": {"sysctls": [{"name": "net.ipv4.tcp_syncookies", "value": "1"}]},
+				"volumes": [{"name": "data", "nfs": {"server": "nfs", "path": "/"}}],
+				"containers": [{"name": "app", "image": "app", "securityContext": {"capabilities": {"add": ["CHOWN"]}}}]}}`,
+		},
+		{
+			name:  "baseline pod level controls",
+			kind:  "Pod",
+			level: LevelBaseline,
+			obj: `{"spec": {"hostIPC": true, "securityContext": {
+					"sysctls": [{"name": "kernel.msgmax", "value": "1"}],
+					"seLinuxOptions": {"type": "spc_t", "user": "root"}},
+				"containers": [{"name": "app", "image": "app", "securityContext": {"procMount": "Unmasked"}}]}}`,
+			want: []string{
+				"spec: host namespaces: hostIPC must not be true",
+				"spec: sysctls: kernel.msgmax must not be set, only kernel.shm_rmid_forced, net.ipv4.ip_local_port_range, net.ipv4.ip_unprivileged_port_start, net.ipv4.tcp_syncookies, net.ipv4.ping_group_range are allowed",
+				"spec: SELinux: securityContext.seLinuxOptions type spc_t is not allowed, user must not be set",
+				"spec.containers[0] (app): /proc mount type: securityContext.procMount must be Default, not Unmasked",
+			},
+		},
+		{
+			name:  "restricted container running as root",
+			kind:  "Pod",
+			level: LevelRestricted,
+			obj: `{"spec": {"securityContext": {"seccompProfile": {"type": "RuntimeDefault"}},
+				"containers": [{"name": "app", "image": "app", "securityContext": {
+					"runAsNonRoot": false, "allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"]}}}]}}`,
+			want: []string{
+				"spec.containers[0] (app): running as non-root: securityContext.runAsNonRoot must not be false",
+			},
+		},
+		{
+			// the pod's security context is unknown, only what the
+			// container sets itself can be checked
+			name:  "ephemeral containers",
+			kind:  "EphemeralContainers",
+			level: LevelRestricted,
+			obj: `{"ephemeralContainers": [{"name": "debugger", "image": "busybox", "securityContext": {
+					"allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"], "add": ["SYS_PTRACE"]}}}]}`,
+			want: []string{
+				"ephemeralContainers[0] (debugger): capabilities: adding SYS_PTRACE is not allowed at level restricted",
+			},
+		},
+	}
+	for _, tt := range tests {
+		obj, err := decodeObject(tt.kind, []byte(tt.obj))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, s := range obj.podSpecs() {
+			got = append(got, checkPodSecurity(tt.level, s)...)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
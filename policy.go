@@ -0,0 +1,547 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy is the declarative configuration evaluated by validate and mutate.
+type Policy struct {
+	Labels           []LabelRule            `json:"labels"`
+	Images           []ImageRule            `json:"images,omitempty"`
+	Mirrors          []MirrorRule           `json:"mirrors,omitempty"`
+	Resources        []ResourceRule         `json:"resources,omitempty"`
+	PodSecurity      []PodSecurityRule      `json:"podSecurity,omitempty"`
+	SecurityDefaults []SecurityDefaultsRule `json:"securityDefaults,omitempty"`
+	CustomKinds      []CustomKind           `json:"customKinds,omitempty"`
+}
+
+// LabelRule requires the label Key on objects of the listed kinds and
+// namespaces. Empty Kinds or Namespaces match everything. Pod templates are
+// evaluated against the rules for kind Pod.
+type LabelRule struct {
+	Name          string   `json:"name"`
+	Key           string   `json:"key"`
+	Kinds         []string `json:"kinds,omitempty"`
+	Namespaces    []string `json:"namespaces,omitempty"`
+	AllowedValues []string `json:"allowedValues,omitempty"`
+	Default       string   `json:"default,omitempty"`
+	// Selector also adds the default to the workload's selector when it is
+	// created. Selectors are immutable, so existing workloads are left alone.
+	Selector bool `json:"selector,omitempty"`
+	Mode     Mode `json:"mode,omitempty"`
+}
+
+// ImageRule restricts the images of the containers, init containers and
+// ephemeral containers of pods and pod templates in the listed namespaces.
+// Empty Namespaces match everything.
+type ImageRule struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Repositories are the registries, such as registry.example.com, or
+	// repository prefixes, such as gcr.io/acme, images must come from.
+	// Empty allows any repository.
+	Repositories []string `json:"repositories,omitempty"`
+	// ForbidLatest denies images tagged latest and images with neither a
+	// tag nor a digest, which the runtime resolves to latest.
+	ForbidLatest bool `json:"forbidLatest,omitempty"`
+	// RequireDigest denies images that are not pinned by a sha256 digest.
+	RequireDigest bool `json:"requireDigest,omitempty"`
+	Mode          Mode `json:"mode,omitempty"`
+}
+
+// MirrorRule makes mutate pull images from a mirror: the images of pods and
+// pod templates in the listed namespaces that come from From are rewritten
+// to come from To, keeping the rest of the repository, the tag and the
+// digest. Empty Namespaces match everything. The first matching rule wins.
+// Pod updates only have the images they change rewritten.
+type MirrorRule struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// From is a registry, such as docker.io, or a repository prefix, such
+	// as gcr.io/acme.
+	From string `json:"from"`
+	// To is the mirror prefix replacing From, such as
+	// mirror.example.com/dockerhub.
+	To string `json:"to"`
+}
+
+// ResourceRule requires the containers and init containers of pods and pod
+// templates in the listed namespaces to request CPU and memory and to limit
+// memory, within bounds. Empty Namespaces match everything.
+type ResourceRule struct {
+	Name       string         `json:"name"`
+	Namespaces []string       `json:"namespaces,omitempty"`
+	CPU        ResourceBounds `json:"cpu"`
+	Memory     ResourceBounds `json:"memory"`
+	// Defaults are filled in by mutate for missing requests and limits.
+	// The first entry whose MatchLabels the pod's labels contain applies.
+	Defaults []ResourceDefaults `json:"defaults,omitempty"`
+	Mode     Mode               `json:"mode,omitempty"`
+}
+
+// ResourceBounds limits the request and limit of one resource. Unset
+// fields are not checked.
+type ResourceBounds struct {
+	Min *resource.Quantity `json:"min,omitempty"`
+	Max *resource.Quantity `json:"max,omitempty"`
+	// MaxLimitRequestRatio bounds the limit divided by the request, like
+	// the field of the same name in a LimitRange.
+	MaxLimitRequestRatio *resource.Quantity `json:"maxLimitRequestRatio,omitempty"`
+}
+
+// ResourceDefaults are the requests and limits of a team's containers.
+// Empty MatchLabels match every pod.
+type ResourceDefaults struct {
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+	Requests    v1.ResourceList   `json:"requests,omitempty"`
+	Limits      v1.ResourceList   `json:"limits,omitempty"`
+}
+
+// PodSecurityRule enforces a level of the Kubernetes Pod Security Standards
+// on pods and pod templates. A namespace gets the first rule listing it or,
+// when none does, the first rule without Namespaces. Pod updates that leave
+// the spec unchanged are not checked.
+type PodSecurityRule struct {
+	Name       string           `json:"name"`
+	Namespaces []string         `json:"namespaces,omitempty"`
+	Level      PodSecurityLevel `json:"level"`
+	Mode       Mode             `json:"mode,omitempty"`
+}
+
+// PodSecurityLevel is a Pod Security Standards profile.
+type PodSecurityLevel string
+
+const (
+	// LevelPrivileged is unrestricted.
+	LevelPrivileged PodSecurityLevel = "privileged"
+	// LevelBaseline prevents known privilege escalations.
+	LevelBaseline PodSecurityLevel = "baseline"
+	// LevelRestricted follows pod hardening best practices.
+	LevelRestricted PodSecurityLevel = "restricted"
+)
+
+func (l PodSecurityLevel) valid() bool {
+	return l == LevelPrivileged || l == LevelBaseline || l == LevelRestricted
+}
+
+// SecurityDefaultsRule makes mutate fill in a hardened securityContext for
+// containers in Namespaces, all namespaces when empty. Fields a container or
+// its pod set are never changed, and pods can opt out of fields with the
+// securityDefaultsOptOutAnnotation.
+type SecurityDefaultsRule struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Mode is how validate acts on a rule violation.
+type Mode string
+
+const (
+	// ModeEnforce denies the request. It is the default.
+	ModeEnforce Mode = "enforce"
+	// ModeWarn allows the request and returns the violation as a warning.
+	ModeWarn Mode = "warn"
+	// ModeAudit allows the request silently and records the violation.
+	ModeAudit Mode = "audit"
+)
+
+func (m Mode) valid() bool {
+	return m == "" || m == ModeEnforce || m == ModeWarn || m == ModeAudit
+}
+
+// violation is a rule a request does not satisfy.
+type violation struct {
+	Rule    string `json:"rule"`
+	Mode    Mode   `json:"mode"`
+	Message string `json:"message"`
+}
+
+// CustomKind maps a kind that is not built into Kubernetes, such as a CRD,
+// to the API resource the webhook has to be registered for.
+type CustomKind struct {
+	Kind     string `json:"kind"`
+	Group    string `json:"group"`
+	Resource string `json:"resource"`
+}
+
+// defaultPolicy is used when no policy file is given and matches the
+// behaviour of the webhook before policies were configurable.
+func defaultPolicy() *Policy {
+	return &Policy{
+		Labels: []LabelRule{{
+			Name:          "team",
+			Key:           "team",
+			AllowedValues: []string{"ops"},
+			Default:       "ops",
+		}},
+	}
+}
+
+// parsePolicy decodes a YAML or JSON policy and validates it.
+func parsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("could not parse policy: %v", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	names := make(map[string]bool)
+	for i, r := range p.Labels {
+		if err := validateRule(names, "labels", i, r.Name, r.Mode, r.Namespaces); err != nil {
+			return err
+		}
+		if errs := validation.IsQualifiedName(r.Key); len(errs) > 0 {
+			return fmt.Errorf("rule %q: invalid label key %q: %s", r.Name, r.Key, strings.Join(errs, ", "))
+		}
+		for _, v := range r.AllowedValues {
+			if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+				return fmt.Errorf("rule %q: invalid allowed value %q: %s", r.Name, v, strings.Join(errs, ", "))
+			}
+		}
+		if r.Default != "" {
+			if errs := validation.IsValidLabelValue(r.Default); len(errs) > 0 {
+				return fmt.Errorf("rule %q: invalid default %q: %s", r.Name, r.Default, strings.Join(errs, ", "))
+			}
+			if len(r.AllowedValues) > 0 && !contains(r.AllowedValues, r.Default) {
+				return fmt.Errorf("rule %q: default %q is not one of the allowed values", r.Name, r.Default)
+			}
+		}
+		if r.Selector && r.Default == "" {
+			return fmt.Errorf("rule %q: selector requires a default", r.Name)
+		}
+		for _, k := range r.Kinds {
+			if k == "" {
+				return fmt.Errorf("rule %q: empty kind", r.Name)
+			}
+		}
+	}
+	for i, r := range p.Images {
+		if err := validateRule(names, "images", i, r.Name, r.Mode, r.Namespaces); err != nil {
+			return err
+		}
+		if len(r.Repositories) == 0 && !r.ForbidLatest && !r.RequireDigest {
+			return fmt.Errorf("rule %q: needs repositories, forbidLatest or requireDigest", r.Name)
+		}
+		for _, repo := range r.Repositories {
+			if err := validRepository(repo); err != nil {
+				return fmt.Errorf("rule %q: invalid repository %q: %v", r.Name, repo, err)
+			}
+		}
+	}
+	for i, r := range p.Mirrors {
+		if err := validateRule(names, "mirrors", i, r.Name, "", r.Namespaces); err != nil {
+			return err
+		}
+		if err := validRepository(r.From); err != nil {
+			return fmt.Errorf("rule %q: invalid from %q: %v", r.Name, r.From, err)
+		}
+		if err := validRepository(r.To); err != nil {
+			return fmt.Errorf("rule %q: invalid to %q: %v", r.Name, r.To, err)
+		}
+		if strings.TrimSuffix(r.From, "/") == strings.TrimSuffix(r.To, "/") {
+			return fmt.Errorf("rule %q: from and to are the same", r.Name)
+		}
+	}
+	for i, r := range p.Resources {
+		if err := validateRule(names, "resources", i, r.Name, r.Mode, r.Namespaces); err != nil {
+			return err
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+	}
+	for i, r := range p.PodSecurity {
+		if err := validateRule(names, "podSecurity", i, r.Name, r.Mode, r.Namespaces); err != nil {
+			return err
+		}
+		if !r.Level.valid() {
+			return fmt.Errorf("rule %q: level must be privileged, baseline or restricted, got %q", r.Name, r.Level)
+		}
+	}
+	for i, r := range p.SecurityDefaults {
+		if err := validateRule(names, "securityDefaults", i, r.Name, "", r.Namespaces); err != nil {
+			return err
+		}
+	}
+	for i, c := range p.CustomKinds {
+		if c.Kind == "" || c.Group == "" || c.Resource == "" {
+			return fmt.Errorf("customKinds[%d]: kind, group and resource are required", i)
+		}
+	}
+	return nil
+}
+
+// validateRule checks the fields every rule has: a name unique across all
+// sections, the mode and the namespaces it is limited to. i is the rule's
+// index in section. Sections without a mode pass an empty one.
+func validateRule(names map[string]bool, section string, i int, name string, mode Mode, namespaces []string) error {
+	if name == "" {
+		return fmt.Errorf("%s[%d]: name is required", section, i)
+	}
+	if names[name] {
+		return fmt.Errorf("%s[%d]: duplicate rule name %q", section, i, name)
+	}
+	names[name] = true
+
+	if !mode.valid() {
+		return fmt.Errorf("rule %q: mode must be enforce, warn or audit, got %q", name, mode)
+	}
+	for _, ns := range namespaces {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("rule %q: invalid namespace %q: %s", name, ns, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func (r *LabelRule) matches(kind, namespace string) bool {
+	if len(r.Kinds) > 0 && !contains(r.Kinds, kind) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && !contains(r.Namespaces, namespace) {
+		return false
+	}
+	return true
+}
+
+// matchingRules returns the names of the label rules that apply to kind.
+func (p *Policy) matchingRules(kind, namespace string) []string {
+	var names []string
+	for _, r := range p.Labels {
+		if r.matches(kind, namespace) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// violations returns one entry per label rule that labels do not satisfy.
+func (p *Policy) violations(kind, namespace string, labels map[string]string) []violation {
+	var out []violation
+	for _, r := range p.Labels {
+		if !r.matches(kind, namespace) {
+			continue
+		}
+		mode := r.Mode
+		if mode == "" {
+			mode = ModeEnforce
+		}
+		value, ok := labels[r.Key]
+		if !ok {
+			out = append(out, violation{r.Name, mode, fmt.Sprintf("label %q is required", r.Key)})
+			continue
+		}
+		if len(r.AllowedValues) > 0 && !contains(r.AllowedValues, value) {
+			out = append(out, violation{r.Name, mode, fmt.Sprintf("label %q value %q is not allowed, must be one of: %s",
+				r.Key, value, strings.Join(r.AllowedValues, ", "))})
+		}
+	}
+	return out
+}
+
+func (r *ImageRule) matches(namespace string) bool {
+	return len(r.Namespaces) == 0 || contains(r.Namespaces, namespace)
+}
+
+// matchingImageRules returns the names of the image rules that apply to
+// pods in namespace.
+func (p *Policy) matchingImageRules(namespace string) []string {
+	var names []string
+	for _, r := range p.Images {
+		if r.matches(namespace) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// imageViolations returns one entry per container and problem with its
+// image under the image rules for namespace.
+func (p *Policy) imageViolations(namespace string, specs []podSpec) []violation {
+	var out []violation
+	for _, r := range p.Images {
+		if !r.matches(namespace) {
+			continue
+		}
+		mode := r.Mode
+		if mode == "" {
+			mode = ModeEnforce
+		}
+		for _, s := range specs {
+			for _, c := range s.containers() {
+				for _, msg := range r.check(c.container.Image) {
+					out = append(out, violation{r.Name, mode, fmt.Sprintf("%s: image %q %s", c, c.container.Image, msg)})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// check returns what is wrong with image under the rule.
+func (r *ImageRule) check(image string) []string {
+	ref, err := parseImage(image)
+	if err != nil {
+		return []string{fmt.Sprintf("is invalid: %v", err)}
+	}
+	var problems []string
+	if len(r.Repositories) > 0 {
+		allowed := false
+		for _, repo := range r.Repositories {
+			if ref.from(repo) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			problems = append(problems, fmt.Sprintf("is not from an allowed repository, must be from one of: %s", strings.Join(r.Repositories, ", ")))
+		}
+	}
+	if r.ForbidLatest {
+		switch {
+		case ref.tag == "latest":
+			problems = append(problems, "uses the latest tag")
+		case ref.tag == "" && ref.digest == "":
+			problems = append(problems, "has no tag or digest")
+		}
+	}
+	if r.RequireDigest && !ref.pinned() {
+		problems = append(problems, "is not pinned by a sha256 digest")
+	}
+	return problems
+}
+
+func (r *MirrorRule) matches(namespace string) bool {
+	return len(r.Namespaces) == 0 || contains(r.Namespaces, namespace)
+}
+
+// matchingMirrorRules returns the names of the mirror rules that apply to
+// pods in namespace.
+func (p *Policy) matchingMirrorRules(namespace string) []string {
+	var names []string
+	for _, r := range p.Mirrors {
+		if r.matches(namespace) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// mirror returns image rewritten by the first mirror rule for namespace it
+// comes from. Images already on one of the mirrors and invalid images, which
+// are left to validation, are not rewritten.
+func (p *Policy) mirror(namespace, image string) (string, bool) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return "", false
+	}
+	var rules []*MirrorRule
+	for i := range p.Mirrors {
+		r := &p.Mirrors[i]
+		if !r.matches(namespace) {
+			continue
+		}
+		if ref.from(r.To) {
+			return "", false
+		}
+		rules = append(rules, r)
+	}
+	for _, r := range rules {
+		if ref.from(r.From) {
+			return r.rewrite(ref), true
+		}
+	}
+	return "", false
+}
+
+// rewrite replaces the From prefix of ref, which must come from it, by To.
+func (r *MirrorRule) rewrite(ref imageRef) string {
+	from := strings.TrimSuffix(r.From, "/")
+	rest := ref.path
+	if strings.Contains(from, "/") {
+		_, path := splitRepository(from)
+		rest = strings.TrimPrefix(strings.TrimPrefix(rest, path), "/")
+	}
+	out := strings.TrimSuffix(r.To, "/")
+	if rest != "" {
+		out += "/" + rest
+	}
+	if ref.tag != "" {
+		out += ":" + ref.tag
+	}
+	if ref.digest != "" {
+		out += "@" + ref.digest
+	}
+	return out
+}
+
+// validRepository checks a registry or repository prefix of an image or
+// mirror rule.
+func validRepository(repo string) error {
+	repo = strings.TrimSuffix(repo, "/")
+	if repo == "" {
+		return fmt.Errorf("empty")
+	}
+	if strings.ContainsAny(repo, "@ \t") || strings.Contains(repo, "://") {
+		return fmt.Errorf("must be a registry or repository without scheme, tag or digest")
+	}
+	if !strings.Contains(repo, "/") {
+		if !strings.ContainsAny(repo, ".:") && repo != "localhost" {
+			return fmt.Errorf("registry must be a host name, such as registry.example.com")
+		}
+		return nil
+	}
+	ref, err := parseImage(repo)
+	if err != nil {
+		return err
+	}
+	if ref.tag != "" {
+		return fmt.Errorf("must not have a tag")
+	}
+	return nil
+}
+
+// defaults returns the default label values that apply to kind in namespace.
+func (p *Policy) defaults(kind, namespace string) map[string]string {
+	values := make(map[string]string)
+	for _, r := range p.Labels {
+		if r.Default != "" && r.matches(kind, namespace) {
+			if _, ok := values[r.Key]; !ok {
+				values[r.Key] = r.Default
+			}
+		}
+	}
+	return values
+}
+
+// selectorKeys returns the label keys that rules want added to the
+// selectors of pod templates in namespace.
+func (p *Policy) selectorKeys(namespace string) []string {
+	var keys []string
+	for _, r := range p.Labels {
+		if r.Selector && r.matches("Pod", namespace) && !contains(keys, r.Key) {
+			keys = append(keys, r.Key)
+		}
+	}
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{name: "valid", policy: "labels: [{name: team, key: team, namespaces: [web]}]"},
+		{name: "unnamed label rule", policy: "labels: [{key: team}]", err: "labels[0]: name is required"},
+		{name: "duplicate label rule", policy: "labels: [{name: team, key: team}, {name: team, key: owner}]", err: `labels[1]: duplicate rule name "team"`},
+		{name: "invalid label mode", policy: "labels: [{name: team, key: team, mode: block}]", err: `rule "team": mode must be enforce, warn or audit, got "block"`},
+		{name: "invalid label namespace", policy: "labels: [{name: team, key: team, namespaces: [Web]}]", err: `rule "team": invalid namespace "Web"`},
+		{name: "unnamed image rule", policy: "images: [{requireDigest: true}]", err: "images[0]: name is required"},
+		{name: "invalid image mode", policy: "images: [{name: pinned, requireDigest: true, mode: block}]", err: `rule "pinned": mode must be enforce, warn or audit, got "block"`},
+		{name: "unnamed mirror rule", policy: "mirrors: [{from: docker.io, to: mirror.example.com}]", err: "mirrors[0]: name is required"},
+		{name: "invalid mirror namespace", policy: "mirrors: [{name: hub, from: docker.io, to: mirror.example.com, namespaces: [web_1]}]", err: `rule "hub": invalid namespace "web_1"`},
+		{name: "duplicate resource rule", policy: "labels: [{name: team, key: team}]\nresources: [{name: team}]", err: `resources[0]: duplicate rule name "team"`},
+		{name: "invalid resource namespace", policy: "resources: [{name: bounds, namespaces: [Web]}]", err: `rule "bounds": invalid namespace "Web"`},
+		{name: "duplicate pod security rule", policy: "labels: [{name: team, key: team}]\npodSecurity: [{name: team, level: baseline}]", err: `podSecurity[0]: duplicate rule name "team"`},
+		{name: "invalid pod security mode", policy: "podSecurity: [{name: pss, level: baseline, mode: block}]", err: `rule "pss": mode must be enforce, warn or audit, got "block"`},
+		{name: "unnamed security defaults rule", policy: "securityDefaults: [{namespaces: [web]}]", err: "securityDefaults[0]: name is required"},
+		{name: "invalid security defaults namespace", policy: "securityDefaults: [{name: harden, namespaces: [web_1]}]", err: `rule "harden": invalid namespace "web_1"`},
+	}
+	for _, tt := range tests {
+		_, err := parsePolicy([]byte(tt.policy))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const builtinRevision = "builtin"
+
+// policyRevision is an immutable, fully validated snapshot of a policy.
+type policyRevision struct {
+	policy   *Policy
+	revision string
+	source   string
+	loadedAt time.Time
+}
+
+// policyStore holds the active policy revision and swaps it atomically
+// when the policy file changes. Readers always see a complete revision.
+type policyStore struct {
+	path    string
+	current atomic.Value // *policyRevision
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// newPolicyStore loads the policy at path, or the built-in default policy
+// when path is empty. An invalid initial policy is an error.
+func newPolicyStore(path string) (*policyStore, error) {
+	s := &policyStore{path: path}
+	if path == "" {
+		s.current.Store(&policyRevision{
+			policy:   defaultPolicy(),
+			revision: builtinRevision,
+			source:   builtinRevision,
+			loadedAt: time.Now(),
+		})
+		return s, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load returns the active policy revision.
+func (s *policyStore) Load() *policyRevision {
+	return s.current.Load().(*policyRevision)
+}
+
+// reload re-reads the policy file and activates it if its content changed.
+// On error the previous revision stays active.
+func (s *policyStore) reload() (bool, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		s.setErr(err)
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	revision := hex.EncodeToString(sum[:])[:12]
+	if cur, ok := s.current.Load().(*policyRevision); ok && cur.revision == revision {
+		s.setErr(nil)
+		return false, nil
+	}
+
+	p, err := parsePolicy(data)
+	if err != nil {
+		s.setErr(err)
+		return false, err
+	}
+	s.current.Store(&policyRevision{
+		policy:   p,
+		revision: revision,
+		source:   s.path,
+		loadedAt: time.Now(),
+	})
+	s.setErr(nil)
+	return true, nil
+}
+
+// watch polls the policy file every interval until stop is closed. Polling
+// rather than inotify copes with the symlink swaps used by ConfigMap volumes.
+func (s *policyStore) watch(interval time.Duration, stop <-chan struct{}) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			prev := s.lastError()
+			changed, err := s.reload()
+			if err != nil {
+				if prev != nil && prev.Error() == err.Error() {
+					continue
+				}
+				log.Error("failed to reload policy, keeping current revision", "file", s.path, "revision", s.Load().revision, "error", err)
+				continue
+			}
+			if changed {
+				log.Info("loaded policy", "file", s.path, "revision", s.Load().revision)
+			}
+		}
+	}
+}
+
+func (s *policyStore) setErr(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+func (s *policyStore) lastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// replayRecord is a line of a capture file: an AdmissionReview sent to an
+// endpoint. Lines holding a bare AdmissionReview are sent to -endpoint.
+type replayRecord struct {
+	Endpoint string          `json:"endpoint"`
+	Review   json.RawMessage `json:"review"`
+}
+
+// replayDecision is what the webhook answered to a captured request. The
+// expected-decision file holds one per line.
+type replayDecision struct {
+	UID       string          `json:"uid"`
+	Endpoint  string          `json:"endpoint"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Operation string          `json:"operation"`
+	Decision  string          `json:"decision"`
+	Message   string          `json:"message,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	Patch     json.RawMessage `json:"patch,omitempty"`
+}
+
+func (d *replayDecision) key() string {
+	return d.Endpoint + " " + d.UID
+}
+
+func (d *replayDecision) String() string {
+	name := d.Name
+	if d.Namespace != "" {
+		name = d.Namespace + "/" + d.Name
+	}
+	return fmt.Sprintf("%s %s %s %s %s", d.Endpoint, d.Operation, d.Kind, name, d.UID)
+}
+
+// runReplay implements the "replay" subcommand.
+func runReplay(args []string) int {
+	var file, expectedFile, policyFile, endpoint string
+	var update bool
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&file, "f", "", "JSONL file of captured AdmissionReviews, - for stdin.")
+	fs.StringVar(&expectedFile, "expected", "", "JSONL file of expected decisions to diff against.")
+	fs.BoolVar(&update, "update", false, "Write the decisions to -expected instead of comparing them.")
+	fs.StringVar(&policyFile, "policyFile", "", "Policy file to replay against. The built-in policy is used when empty.")
+	fs.StringVar(&endpoint, "endpoint", "/validate", "Endpoint for records that are a bare AdmissionReview.")
+	fs.Parse(args)
+	log.configure("text", "error", false)
+
+	if file == "" || (update && expectedFile == "") {
+		fmt.Fprintln(os.Stderr, "usage: k8s-ac replay -f CAPTURE [-expected DECISIONS [-update]] [flags]")
+		return 2
+	}
+	policies, err := newPolicyStore(policyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid policy file %s: %v\n", policyFile, err)
+		return 1
+	}
+
+	in := os.Stdin
+	if file != "-" {
+		if in, err = os.Open(file); err != nil {
+			fmt.Fprintf(os.Stderr, "could not open %s: %v\n", file, err)
+			return 1
+		}
+		defer in.Close()
+	}
+	records, err := readReplayRecords(in, endpoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read %s: %v\n", file, err)
+		return 1
+	}
+
+	ws := &WebHookServer{policies: policies}
+	var decisions []*replayDecision
+	for i, rec := range records {
+		d, err := ws.replay(rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "record %d: %v\n", i+1, err)
+			return 1
+		}
+		decisions = append(decisions, d)
+	}
+
+	switch {
+	case update:
+		if err := writeDecisions(expectedFile, decisions); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write %s: %v\n", expectedFile, err)
+			return 1
+		}
+		fmt.Printf("wrote %d decisions to %s\n", len(decisions), expectedFile)
+		return 0
+	case expectedFile == "":
+		for _, d := range decisions {
+			fmt.Printf("%s: %s\n", d, d.Decision)
+		}
+		return 0
+	}
+
+	expected, err := readDecisions(expectedFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read %s: %v\n", expectedFile, err)
+		return 1
+	}
+	diffs := diffDecisions(expected, decisions)
+	for _, line := range diffs {
+		fmt.Println(line)
+	}
+	fmt.Printf("%d requests replayed, %d differ from %s\n", len(decisions), len(diffs), expectedFile)
+	if len(diffs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func readReplayRecords(r io.Reader, endpoint string) ([]replayRecord, error) {
+	var records []replayRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rec := replayRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if rec.Review == nil {
+			rec = replayRecord{Endpoint: endpoint, Review: append(json.RawMessage{}, line...)}
+		}
+		if rec.Endpoint == "" {
+			rec.Endpoint = endpoint
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// replay sends rec through serve, exactly as the API server would.
+func (ws *WebHookServer) replay(rec replayRecord) (*replayDecision, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, rec.Endpoint, bytes.NewReader(rec.Review))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := &replayWriter{header: make(http.Header)}
+	ws.serve(w, httpReq)
+
+	ar, _, err := decodeReview(rec.Review)
+	if err != nil {
+		return nil, err
+	}
+	if ar.Request == nil {
+		return nil, fmt.Errorf("AdmissionReview has no request")
+	}
+	d := &replayDecision{
+		UID:       string(ar.Request.UID),
+		Endpoint:  rec.Endpoint,
+		Kind:      ar.Request.Kind.Kind,
+		Namespace: ar.Request.Namespace,
+		Name:      ar.Request.Name,
+		Operation: string(ar.Request.Operation),
+	}
+	review := admissionReviewResponse{}
+	if err := json.Unmarshal(w.body.Bytes(), &review); err != nil {
+		d.Decision = outcomeError
+		d.Message = strings.TrimSpace(w.body.String())
+		return d, nil
+	}
+	d.Decision = responseOutcome(review.Response)
+	if review.Response != nil {
+		if review.Response.Result != nil {
+			d.Message = review.Response.Result.Message
+		}
+		d.Warnings = review.Response.Warnings
+		d.Patch = review.Response.Patch
+	}
+	return d, nil
+}
+
+// replayWriter keeps the response serve writes for a replayed request.
+type replayWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *replayWriter) Header() http.Header         { return w.header }
+func (w *replayWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *replayWriter) WriteHeader(int)             {}
+
+func readDecisions(path string) (map[string]*replayDecision, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decisions := make(map[string]*replayDecision)
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		d := &replayDecision{}
+		if err := json.Unmarshal(line, d); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		decisions[d.key()] = d
+	}
+	return decisions, nil
+}
+
+func writeDecisions(path string, decisions []*replayDecision) error {
+	var buf bytes.Buffer
+	for _, d := range decisions {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// diffDecisions describes every replayed decision that differs from the
+// expected one, and expected decisions that were not replayed.
+func diffDecisions(expected map[string]*replayDecision, got []*replayDecision) []string {
+	var diffs []string
+	seen := make(map[string]bool)
+	for _, d := range got {
+		seen[d.key()] = true
+		want, ok := expected[d.key()]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: new request, %s", d, d.Decision))
+			continue
+		}
+		if want.Decision != d.Decision {
+			line := fmt.Sprintf("%s: %s -> %s", d, want.Decision, d.Decision)
+			if d.Message != "" {
+				line += ": " + d.Message
+			}
+			diffs = append(diffs, line)
+			continue
+		}
+		if want.Message != d.Message {
+			diffs = append(diffs, fmt.Sprintf("%s: message %q -> %q", d, want.Message, d.Message))
+		}
+		if !reflect.DeepEqual(want.Warnings, d.Warnings) {
+			diffs = append(diffs, fmt.Sprintf("%s: warnings %q -> %q", d, want.Warnings, d.Warnings))
+		}
+		if !jsonEqual(want.Patch, d.Patch) {
+			diffs = append(diffs, fmt.Sprintf("%s: patch %s -> %s", d, orNone(want.Patch), orNone(d.Patch)))
+		}
+	}
+	var missing []string
+	for key, want := range expected {
+		if !seen[key] {
+			missing = append(missing, fmt.Sprintf("%s: not replayed, expected %s", want, want.Decision))
+		}
+	}
+	sort.Strings(missing)
+	return append(diffs, missing...)
+}
+
+// jsonEqual compares two JSON documents ignoring formatting.
+func jsonEqual(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func orNone(patch json.RawMessage) string {
+	if len(patch) == 0 {
+		return "none"
+	}
+	return string(patch)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestReplay replays testdata/replay/capture.jsonl against testdata/policy.yaml
+// and diffs the decisions against testdata/replay/decisions.jsonl.
+// Run with -update to regenerate decisions.jsonl.
+func TestReplay(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	in, err := os.Open(filepath.Join("testdata", "replay", "capture.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	records, err := readReplayRecords(in, "/validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := newPolicyStore(filepath.Join("testdata", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &WebHookServer{policies: policies}
+	var decisions []*replayDecision
+	for _, rec := range records {
+		d, err := ws.replay(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions = append(decisions, d)
+	}
+
+	expectedFile := filepath.Join("testdata", "replay", "decisions.jsonl")
+	if *update {
+		if err := writeDecisions(expectedFile, decisions); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := readDecisions(expectedFile)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	if diffs := diffDecisions(expected, decisions); len(diffs) > 0 {
+		t.Errorf("decisions differ from %s, run with -update to accept:\n%q", expectedFile, diffs)
+	}
+
+	// a changed decision and a request that was not replayed are reported
+	allowed := *expected["/validate v-2"]
+	allowed.Decision, allowed.Message = outcomeAllowed, ""
+	expected["/validate v-2"] = &allowed
+	expected["/validate v-99"] = &replayDecision{UID: "v-99", Endpoint: "/validate", Kind: "Pod", Namespace: "default", Name: "db", Operation: "CREATE", Decision: outcomeAllowed}
+	want := []string{
+		`/validate CREATE Pod default/web v-2: allowed -> denied: label "team" is required`,
+		`/validate CREATE Pod default/db v-99: not replayed, expected allowed`,
+	}
+	if diffs := diffDecisions(expected, decisions); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("got diffs\n%q\nwant\n%q", diffs, want)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// checkedResources are the resources resource rules bound, in the order
+// they are reported.
+var checkedResources = []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory}
+
+func (r *ResourceRule) bounds(name v1.ResourceName) ResourceBounds {
+	if name == v1.ResourceCPU {
+		return r.CPU
+	}
+	return r.Memory
+}
+
+func (r *ResourceRule) validate() error {
+	for _, name := range checkedResources {
+		b := r.bounds(name)
+		if b.Min != nil && b.Max != nil && b.Min.Cmp(*b.Max) > 0 {
+			return fmt.Errorf("%s min %s is above max %s", name, b.Min, b.Max)
+		}
+		if b.MaxLimitRequestRatio != nil && b.MaxLimitRequestRatio.Cmp(resource.MustParse("1")) < 0 {
+			return fmt.Errorf("%s maxLimitRequestRatio %s must be at least 1", name, b.MaxLimitRequestRatio)
+		}
+	}
+	for i, d := range r.Defaults {
+		for _, list := range []v1.ResourceList{d.Requests, d.Limits} {
+			for name, q := range list {
+				if name != v1.ResourceCPU && name != v1.ResourceMemory {
+					return fmt.Errorf("defaults[%d]: only cpu and memory can be defaulted, got %s", i, name)
+				}
+				// defaults must pass validation, or mutate would fill in
+				// values that get the pod denied
+				if msg := r.bounds(name).outOfBounds(q); msg != "" {
+					return fmt.Errorf("defaults[%d]: %s %s %s", i, name, q.String(), msg)
+				}
+			}
+		}
+		for name, request := range d.Requests {
+			if limit, ok := d.Limits[name]; ok && request.Cmp(limit) > 0 {
+				return fmt.Errorf("defaults[%d]: %s request %s is above the limit %s", i, name, request.String(), limit.String())
+			}
+		}
+		for key, value := range d.MatchLabels {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("defaults[%d]: invalid label key %q: %s", i, key, strings.Join(errs, ", "))
+			}
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return fmt.Errorf("defaults[%d]: invalid label value %q: %s", i, value, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// outOfBounds describes how q is outside b, or returns "" when it is not.
+func (b ResourceBounds) outOfBounds(q resource.Quantity) string {
+	if b.Min != nil && q.Cmp(*b.Min) < 0 {
+		return fmt.Sprintf("is below the minimum %s", b.Min)
+	}
+	if b.Max != nil && q.Cmp(*b.Max) > 0 {
+		return fmt.Sprintf("is above the maximum %s", b.Max)
+	}
+	return ""
+}
+
+func (r *ResourceRule) matches(namespace string) bool {
+	return len(r.Namespaces) == 0 || contains(r.Namespaces, namespace)
+}
+
+// matchingResourceRules returns the names of the resource rules that apply
+// to pods in namespace.
+func (p *Policy) matchingResourceRules(namespace string) []string {
+	var names []string
+	for _, r := range p.Resources {
+		if r.matches(namespace) {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// resourceViolations returns one entry per container and problem with its
+// requests and limits under the resource rules for namespace. Ephemeral
+// containers have no resources and are not checked.
+func (p *Policy) resourceViolations(namespace string, specs []podSpec) []violation {
+	var out []violation
+	for _, r := range p.Resources {
+		if !r.matches(namespace) {
+			continue
+		}
+		mode := r.Mode
+		if mode == "" {
+			mode = ModeEnforce
+		}
+		for _, s := range specs {
+			for _, c := range s.containers() {
+				if c.ephemeral {
+					continue
+				}
+				for _, msg := range r.check(c.container.Resources) {
+					out = append(out, violation{r.Name, mode, fmt.Sprintf("%s: %s", c, msg)})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// check returns what is wrong with the requests and limits of a container.
+func (r *ResourceRule) check(res v1.ResourceRequirements) []string {
+	var problems []string
+	for _, name := range checkedResources {
+		b := r.bounds(name)
+		request, hasRequest := res.Requests[name]
+		limit, hasLimit := res.Limits[name]
+		// Kubernetes sets a missing request to the limit
+		if !hasRequest && hasLimit {
+			request, hasRequest = limit, true
+		}
+		if !hasRequest {
+			problems = append(problems, fmt.Sprintf("does not request %s", name))
+		} else if msg := b.outOfBounds(request); msg != "" {
+			problems = append(problems, fmt.Sprintf("%s request %s %s", name, request.String(), msg))
+		}
+		if !hasLimit {
+			if name == v1.ResourceMemory {
+				problems = append(problems, "has no memory limit")
+			}
+		} else if msg := b.outOfBounds(limit); msg != "" {
+			problems = append(problems, fmt.Sprintf("%s limit %s %s", name, limit.String(), msg))
+		}
+		if hasRequest && hasLimit && b.MaxLimitRequestRatio != nil && !request.IsZero() &&
+			quantityFloat(limit)/quantityFloat(request) > quantityFloat(*b.MaxLimitRequestRatio) {
+			problems = append(problems, fmt.Sprintf("%s limit %s is more than %s times the request %s",
+				name, limit.String(), b.MaxLimitRequestRatio, request.String()))
+		}
+	}
+	return problems
+}
+
+// defaults returns the first entry of the rule for a pod with labels.
+func (r *ResourceRule) defaults(labels map[string]string) *ResourceDefaults {
+	for i, d := range r.Defaults {
+		matched := true
+		for key, value := range d.MatchLabels {
+			if v, ok := labels[key]; !ok || v != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return &r.Defaults[i]
+		}
+	}
+	return nil
+}
+
+// resourceDefaults returns the requests and limits the resource rules for
+// namespace fill in for a pod with labels. Earlier rules take precedence.
+func (p *Policy) resourceDefaults(namespace string, labels map[string]string) (requests, limits v1.ResourceList) {
+	requests, limits = v1.ResourceList{}, v1.ResourceList{}
+	for _, r := range p.Resources {
+		if !r.matches(namespace) {
+			continue
+		}
+		d := r.defaults(labels)
+		if d == nil {
+			continue
+		}
+		for name, q := range d.Requests {
+			if _, ok := requests[name]; !ok {
+				requests[name] = q
+			}
+		}
+		for name, q := range d.Limits {
+			if _, ok := limits[name]; !ok {
+				limits[name] = q
+			}
+		}
+	}
+	return requests, limits
+}
+
+// quantityFloat approximates q, for ratios that do not need to be exact.
+func quantityFloat(q resource.Quantity) float64 {
+	f, _ := strconv.ParseFloat(q.AsDec().String(), 64)
+	return f
+}
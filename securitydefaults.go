@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// securityDefaultsOptOutAnnotation lists, comma separated, the hardened
+// fields mutate must not fill in for the containers of a pod.
+const securityDefaultsOptOutAnnotation = "k8s-ac/security-defaults-opt-out"
+
+// hardenedFields are the securityContext fields security defaults fill in,
+// by the name pods opt out of them with.
+var hardenedFields = []string{"runAsNonRoot", "readOnlyRootFilesystem", "allowPrivilegeEscalation", "capabilities", "seccompProfile"}
+
+// securityOptOut records the hardened fields a pod opted out of.
+type securityOptOut struct {
+	Rule   string   `json:"rule"`
+	Path   string   `json:"path"`
+	Fields []string `json:"fields"`
+}
+
+func (o securityOptOut) String() string {
+	return fmt.Sprintf("%s: %s", o.Path, strings.Join(o.Fields, ", "))
+}
+
+// securityDefaultsRule returns the first rule for namespace, nil when there
+// is none. Rules all fill in the same fields.
+func (p *Policy) securityDefaultsRule(namespace string) *SecurityDefaultsRule {
+	for i, r := range p.SecurityDefaults {
+		if len(r.Namespaces) == 0 || contains(r.Namespaces, namespace) {
+			return &p.SecurityDefaults[i]
+		}
+	}
+	return nil
+}
+
+// matchingSecurityDefaultsRules returns the name of the security defaults
+// rule that applies to pods in namespace.
+func (p *Policy) matchingSecurityDefaultsRules(namespace string) []string {
+	if r := p.securityDefaultsRule(namespace); r != nil {
+		return []string{r.Name}
+	}
+	return nil
+}
+
+// hardenSecurityContext returns the operations filling in the hardened
+// securityContext fields that containers and their pods leave unset, the
+// fields pods opted out of, and notes on opt-outs naming unknown fields.
+func hardenSecurityContext(req *v1beta1.AdmissionRequest, obj *admissionObject, policy *Policy) (patch []patchOperation, optOuts []securityOptOut, notes []string) {
+	r := policy.securityDefaultsRule(req.Namespace)
+	// the securityContext of a pod's containers and a Job's pod template
+	// are immutable
+	if r == nil || (obj.pod != nil && req.Operation != v1beta1.Create) || immutableTemplate(req) {
+		return nil, nil, nil
+	}
+	for _, s := range obj.podSpecs() {
+		skip := make(map[string]bool)
+		var fields []string
+		for _, f := range strings.Split(s.annotations[securityDefaultsOptOutAnnotation], ",") {
+			f = strings.TrimSpace(f)
+			switch {
+			case f == "" || skip[f]:
+			case !contains(hardenedFields, f):
+				notes = append(notes, fmt.Sprintf("%s: ignoring unknown field %q in %s, expected one of %s",
+					fieldPath(s.path), f, securityDefaultsOptOutAnnotation, strings.Join(hardenedFields, ", ")))
+			default:
+				skip[f] = true
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) > 0 {
+			optOuts = append(optOuts, securityOptOut{Rule: r.Name, Path: fieldPath(s.path), Fields: fields})
+		}
+		for _, c := range s.containers() {
+			if !c.ephemeral {
+				patch = append(patch, hardenContainer(s, c, skip)...)
+			}
+		}
+	}
+	return patch, optOuts, notes
+}
+
+// hardenContainer returns the operations filling in the hardened fields
+// that are not in skip and that neither the container nor its pod set.
+func hardenContainer(s podSpec, c containerRef, skip map[string]bool) []patchOperation {
+	psc := s.spec.SecurityContext
+	if psc == nil {
+		psc = &v1.PodSecurityContext{}
+	}
+	sc := c.container.SecurityContext
+	if sc == nil {
+		sc = &v1.SecurityContext{}
+	}
+	runAsUser := sc.RunAsUser
+	if runAsUser == nil {
+		runAsUser = psc.RunAsUser
+	}
+	privileged := sc.Privileged != nil && *sc.Privileged
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Add {
+			privileged = privileged || capability == "SYS_ADMIN" || capability == "CAP_SYS_ADMIN"
+		}
+	}
+
+	values := make(map[string]interface{})
+	// a container asking to run as root would no longer start
+	if !skip["runAsNonRoot"] && sc.RunAsNonRoot == nil && psc.RunAsNonRoot == nil && (runAsUser == nil || *runAsUser != 0) {
+		values["runAsNonRoot"] = true
+	}
+	if !skip["readOnlyRootFilesystem"] && sc.ReadOnlyRootFilesystem == nil {
+		values["readOnlyRootFilesystem"] = true
+	}
+	// the API server refuses it for privileged containers and CAP_SYS_ADMIN
+	if !skip["allowPrivilegeEscalation"] && sc.AllowPrivilegeEscalation == nil && !privileged {
+		values["allowPrivilegeEscalation"] = false
+	}
+	if !skip["seccompProfile"] && s.containerSeccomp(c) == nil {
+		values["seccompProfile"] = seccompProfile{Type: "RuntimeDefault"}
+	}
+	dropAll := !skip["capabilities"] && (sc.Capabilities == nil || sc.Capabilities.Drop == nil)
+	if dropAll && sc.Capabilities == nil {
+		values["capabilities"] = map[string][]string{"drop": {"ALL"}}
+	}
+
+	path := c.pointer + "/securityContext"
+	if c.container.SecurityContext == nil {
+		if len(values) == 0 {
+			return nil
+		}
+		return []patchOperation{{Op: "add", Path: path, Value: values}}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var patch []patchOperation
+	for _, key := range keys {
+		patch = append(patch, patchOperation{Op: "add", Path: path + "/" + key, Value: values[key]})
+	}
+	if dropAll && sc.Capabilities != nil {
+		patch = append(patch, patchOperation{Op: "add", Path: path + "/capabilities/drop", Value: []string{"ALL"}})
+	}
+	return patch
+}
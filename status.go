@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type policyStatus struct {
+	Revision  string    `json:"revision"`
+	Source    string    `json:"source"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+type certificateStatus struct {
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+type serverStatus struct {
+	Policy      policyStatus      `json:"policy"`
+	Certificate certificateStatus `json:"certificate"`
+}
+
+// statusHandler reports the active policy revision and serving certificate.
+func statusHandler(policies *policyStore, certs *keyPairReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rev := policies.Load()
+		status := serverStatus{
+			Policy: policyStatus{
+				Revision: rev.revision,
+				Source:   rev.source,
+				LoadedAt: rev.loadedAt,
+			},
+		}
+		if err := policies.lastError(); err != nil {
+			status.Policy.LastError = err.Error()
+		}
+		leaf := certs.leaf()
+		status.Certificate = certificateStatus{
+			Subject:   leaf.Subject.String(),
+			DNSNames:  leaf.DNSNames,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		}
+		if err := certs.lastError(); err != nil {
+			status.Certificate.LastError = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
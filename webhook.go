@@ -3,206 +3,482 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
 
-	"github.com/golang/glog"
 	"k8s.io/api/admission/v1beta1"
-	appsv1 "k8s.io/api/apps/v1"
-	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-var reqLabel = map[string]string{
-	"team": "ops",
-}
-
 //WebHookServer listen to admission requests and serve responses
 type WebHookServer struct {
+	policies *policyStore
+	// audit receives a record of every decision, it may be nil.
+	audit *auditLog
+	// maxRequestBytes limits the size of an AdmissionReview, 0 means no limit.
+	maxRequestBytes int64
+	// timeout is the webhook's timeoutSeconds, 0 means no deadline.
+	timeout time.Duration
+	// failOpen allows requests whose evaluation missed the deadline, they
+	// are denied otherwise.
+	failOpen bool
+	// requireClientCert refuses callers without a verified client certificate.
+	requireClientCert bool
+	// health counts the evaluations running, it may be nil.
+	health *health
+	// evaluate replaces mutate and validate when it is set, tests use it to
+	// control how long an evaluation takes.
+	evaluate func(*v1beta1.AdmissionReview, *Policy) *admissionResponse
 }
 
-type patchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
-}
-
-func updLabel(target map[string]string, added map[string]string) (patch []patchOperation) {
-	values := make(map[string]string)
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			values[key] = value
+func reqMutation(m map[string]string, defaults map[string]string) bool {
+	for key := range defaults {
+		if _, ok := m[key]; !ok {
+			return true
 		}
 	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/labels",
-		Value: values,
-	})
-	return patch
-}
-func createPatch(availableLabel map[string]string, label map[string]string) ([]byte, error) {
-	var patch []patchOperation
-
-	patch = append(patch, updLabel(availableLabel, label)...)
-
-	return json.Marshal(patch)
+	log.Debug("skipping mutation, required labels already exist")
+	return false
 }
+func (ws *WebHookServer) validate(ar *v1beta1.AdmissionReview, policy *Policy) *admissionResponse {
 
-func reqMutation(m map[string]string) bool {
-	if _, ok := m["team"]; ok {
-		glog.V(3).Infof("skipping mutation, spanContext annotation already exists")
-		return false
+	raw := ar.Request.Object.Raw
+	rlog := requestLogger(ar.Request)
+	rlog.Debug("validating", "resource", ar.Request.Resource.String(), "user", ar.Request.UserInfo)
+	// ephemeral containers are added through a subresource, their images
+	// are checked like those of any other container
+	ephemeral := ar.Request.SubResource == "ephemeralcontainers"
+	if ar.Request.SubResource != "" && !ephemeral {
+		return &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed: true,
+		}}
 	}
+	obj, err := decodeObject(ar.Request.Kind.Kind, raw)
+	if err != nil {
+		rlog.Warn("can't decode object", "error", err)
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("can't decode %s: %v", ar.Request.Kind.Kind, err))
 
-	return true
-
-}
-func (ws *WebHookServer) validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-
-	raw := ar.Request.Object.Raw
-	glog.Infof("VALIDATION:AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
-		ar.Request.Kind, ar.Request.Namespace, ar.Request.Name, ar.Request.UID, ar.Request.Operation, ar.Request.UserInfo)
-	pod := v1.Pod{}
-	deployment := appsv1.Deployment{}
-
-	if err := json.Unmarshal(raw, &pod); err != nil {
-		glog.Error("error deserializing pods")
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+	}
+	var violations []violation
+	var rules []string
+	if !ephemeral {
+		violations = policy.violations(ar.Request.Kind.Kind, ar.Request.Namespace, obj.meta.Labels)
+		// labels on pod templates end up on pods, so they must satisfy the
+		// pod rules. Templates that cannot be updated are not held against
+		// the update.
+		for _, t := range obj.templates {
+			if immutableTemplate(ar.Request) {
+				break
+			}
+			for _, v := range policy.violations("Pod", ar.Request.Namespace, t.template.Labels) {
+				v.Message = fmt.Sprintf("%s: %s", fieldPath(t.path+"/metadata/labels"), v.Message)
+				violations = append(violations, v)
+			}
 		}
-
+		rules = matchedRules(ar.Request, obj, policy)
 	}
-	if err := json.Unmarshal(raw, &deployment); err != nil {
-		glog.Error("error deserializing deployments")
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+	if specs := obj.podSpecs(); len(specs) > 0 {
+		violations = append(violations, policy.imageViolations(ar.Request.Namespace, specs)...)
+		rules = append(rules, policy.matchingImageRules(ar.Request.Namespace)...)
+		if !podSpecUnchanged(ar.Request, obj) {
+			violations = append(violations, policy.podSecurityViolations(ar.Request.Namespace, specs)...)
+			rules = append(rules, policy.matchingPodSecurityRules(ar.Request.Namespace)...)
+		}
+		if !ephemeral {
+			violations = append(violations, policy.resourceViolations(ar.Request.Namespace, specs)...)
+			rules = append(rules, policy.matchingResourceRules(ar.Request.Namespace)...)
 		}
 	}
-	if pod.ObjectMeta.Labels["team"] == reqLabel["team"] {
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+
+	// audit mode violations are only recorded in the audit log
+	var denials, warnings []string
+	for _, v := range violations {
+		switch v.Mode {
+		case ModeWarn:
+			warnings = append(warnings, fmt.Sprintf("%s: %s", v.Rule, v.Message))
+		case ModeEnforce:
+			denials = append(denials, v.Message)
 		}
 	}
-	if deployment.Labels["team"] == reqLabel["team"] {
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+	if len(denials) == 0 {
+		return &admissionResponse{
+			AdmissionResponse: v1beta1.AdmissionResponse{
+				Allowed: true,
+			},
+			Warnings:   warnings,
+			rules:      rules,
+			violations: violations,
 		}
 	}
-	fmt.Printf("VALIDATION:This is %v value with lables \n", pod.ObjectMeta.Labels)
-	fmt.Printf("VALIDATION:This is %v value with lables \n", deployment.Labels)
 
-	return &v1beta1.AdmissionResponse{
-		Allowed: false,
-		Result: &metav1.Status{
-			Message: "This label 'team' is not allowed !",
+	return &admissionResponse{
+		AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: strings.Join(denials, "; "),
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+			},
 		},
+		Warnings:   warnings,
+		rules:      rules,
+		violations: violations,
 	}
 }
 
-func (ws *WebHookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	var availableLabel map[string]string
-	rk := ar.Request.Kind
+func (ws *WebHookServer) mutate(ar *v1beta1.AdmissionReview, policy *Policy) *admissionResponse {
 	raw := ar.Request.Object.Raw
-	pod := v1.Pod{}
-	deployment := appsv1.Deployment{}
-
-	glog.Infof("MUTATION:AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
-		ar.Request.Kind, ar.Request.Namespace, ar.Request.Name, ar.Request.UID, ar.Request.Operation, ar.Request.UserInfo)
-
-	switch rk.Kind {
-	case "Pod":
-		if err := json.Unmarshal(raw, &pod); err != nil {
-			glog.Error("error deserializing pod")
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		availableLabel = pod.ObjectMeta.Labels
-	case "Deployment":
-		if err := json.Unmarshal(raw, &deployment); err != nil {
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+
+	rlog := requestLogger(ar.Request)
+	rlog.Debug("mutating", "resource", ar.Request.Resource.String(), "user", ar.Request.UserInfo)
+
+	// only the images of ephemeral containers are mirrored when they are
+	// added through their subresource
+	ephemeral := ar.Request.SubResource == "ephemeralcontainers"
+	if ar.Request.SubResource != "" && !ephemeral {
+		return &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed: true,
+		}}
+	}
+	obj, err := decodeObject(ar.Request.Kind.Kind, raw)
+	if err != nil {
+		rlog.Warn("can't decode object", "error", err)
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("can't decode %s: %v", ar.Request.Kind.Kind, err))
+	}
+	var patch []patchOperation
+	var notes, warnings, rules []string
+	var optOuts []securityOptOut
+	if ephemeral {
+		patch = mirrorImages(ar.Request.Namespace, obj, policy, true, unchangedImages(ar.Request, obj))
+	} else {
+		patch, notes = createPatch(ar.Request, obj, policy)
+		var hardened []patchOperation
+		hardened, optOuts, warnings = hardenSecurityContext(ar.Request, obj, policy)
+		patch = append(patch, hardened...)
+		rules = matchedRules(ar.Request, obj, policy)
+	}
+	for _, note := range notes {
+		rlog.Info("mutation skipped", "reason", note)
+	}
+	for _, o := range optOuts {
+		rlog.Info("security defaults opted out", "path", o.Path, "fields", o.Fields)
+	}
+	if len(obj.podSpecs()) > 0 {
+		rules = append(rules, policy.matchingMirrorRules(ar.Request.Namespace)...)
+		if !ephemeral {
+			rules = append(rules, policy.matchingResourceRules(ar.Request.Namespace)...)
+			rules = append(rules, policy.matchingSecurityDefaultsRules(ar.Request.Namespace)...)
 		}
-		availableLabel = deployment.Labels
 	}
-	if !reqMutation(availableLabel) {
-		return &v1beta1.AdmissionResponse{
+	resp := &admissionResponse{
+		AdmissionResponse: v1beta1.AdmissionResponse{
 			Allowed: true,
+		},
+		Warnings: append(notes, warnings...),
+		rules:    rules,
+		optOuts:  optOuts,
+	}
+	if len(notes) > 0 || len(optOuts) > 0 {
+		resp.AuditAnnotations = make(map[string]string)
+	}
+	if len(notes) > 0 {
+		resp.AuditAnnotations["mutation-skipped"] = strings.Join(notes, "; ")
+	}
+	if len(optOuts) > 0 {
+		declined := make([]string, 0, len(optOuts))
+		for _, o := range optOuts {
+			declined = append(declined, o.String())
 		}
+		resp.AuditAnnotations["security-defaults-opt-out"] = strings.Join(declined, "; ")
+	}
+	if len(patch) == 0 {
+		return resp
 	}
-	pBytes, err := createPatch(availableLabel, reqLabel)
+	pBytes, err := json.Marshal(patch)
 	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return errorResponse(http.StatusInternalServerError, err)
 	}
 
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   pBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
+	resp.Patch = pBytes
+	resp.PatchType = func() *v1beta1.PatchType {
+		pt := v1beta1.PatchTypeJSONPatch
+		return &pt
+	}()
+	return resp
+}
+
+// isDryRun reports whether the request must not have side effects.
+func isDryRun(req *v1beta1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// matchedRules returns the rules that apply to the object, including the
+// pod rules applied to its templates.
+func matchedRules(req *v1beta1.AdmissionRequest, obj *admissionObject, policy *Policy) []string {
+	rules := policy.matchingRules(req.Kind.Kind, req.Namespace)
+	if len(obj.templates) == 0 {
+		return rules
 	}
+	for _, name := range policy.matchingRules("Pod", req.Namespace) {
+		if !contains(rules, name) {
+			rules = append(rules, name)
+		}
+	}
+	return rules
 }
 
+// serve answers an AdmissionReview posted to /mutate or /validate. Every
+// failure is answered with an AdmissionReview whose status carries the code
+// and reason, and the same HTTP status code.
 func (ws *WebHookServer) serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+	start := time.Now()
+	apiVersion := admissionV1
+	var req *v1beta1.AdmissionRequest
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
 		}
+		ws.finish(w, r, http.StatusInternalServerError, start, apiVersion, "", req, panicResponse(r, req, p))
+	}()
+
+	ar, version, rerr := ws.readReview(r)
+	if version == admissionV1beta1 {
+		apiVersion = version
 	}
-	if len(body) == 0 {
-		glog.Error("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
+	if rerr != nil {
+		log.Warn("rejecting request", "path", r.URL.Path, "method", r.Method, "error", rerr.err)
+		ws.finish(w, r, rerr.code, start, apiVersion, "", nil, errorResponse(rerr.code, rerr.err))
+		return
+	}
+	req = ar.Request
+
+	// every request is evaluated against a single policy revision
+	rev := ws.policies.Load()
+	var evaluate func(*v1beta1.AdmissionReview, *Policy) *admissionResponse
+	switch r.URL.Path {
+	case "/mutate":
+		evaluate = ws.mutate
+	case "/validate":
+		evaluate = ws.validate
+	default:
+		resp := errorResponse(http.StatusNotFound, fmt.Errorf("unknown endpoint %s", r.URL.Path))
+		ws.finish(w, r, http.StatusNotFound, start, apiVersion, rev.revision, req, resp)
 		return
 	}
+	if ws.evaluate != nil {
+		evaluate = ws.evaluate
+	}
 
-	var admResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := json.Unmarshal(body, &ar); err != nil {
-		glog.Error("incorrect body")
-		http.Error(w, "incorrect body", http.StatusBadRequest)
+	deadline := ws.deadline(r)
+	if deadline <= 0 {
+		ws.finish(w, r, http.StatusOK, start, apiVersion, rev.revision, req, evaluate(ar, rev.policy))
+		return
 	}
-	glog.Info("Received request")
-	fmt.Println(r.URL.Path)
-	if r.URL.Path == "/mutate" {
-		admResponse = ws.mutate(&ar)
-		fmt.Printf("MUTATION:Response Allowed: %v \n", admResponse.Allowed)
+	// an evaluation that misses the deadline runs to completion in the
+	// background, its result is discarded. It stays in ws.health until it
+	// returns so /healthz notices evaluations that never do.
+	done := make(chan evaluation, 1)
+	go func() {
+		defer ws.health.evaluating()()
+		defer func() {
+			if p := recover(); p != nil {
+				done <- evaluation{http.StatusInternalServerError, panicResponse(r, req, p)}
+			}
+		}()
+		done <- evaluation{http.StatusOK, evaluate(ar, rev.policy)}
+	}()
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case e := <-done:
+		ws.finish(w, r, e.code, start, apiVersion, rev.revision, req, e.resp)
+	case <-timer.C:
+		requestLogger(req).Warn("evaluation deadline exceeded", "path", r.URL.Path, "deadline", deadline, "failOpen", ws.failOpen)
+		ws.finish(w, r, http.StatusOK, start, apiVersion, rev.revision, req, timeoutResponse(deadline, ws.failOpen))
 	}
-	if r.URL.Path == "/validate" {
-		admResponse = ws.validate(&ar)
-		fmt.Printf("VALIDATION:Response Allowed: %v \n", admResponse.Allowed)
+}
+
+type evaluation struct {
+	code int
+	resp *admissionResponse
+}
+
+// panicResponse logs the panic p and answers with an internal error.
+func panicResponse(r *http.Request, req *v1beta1.AdmissionRequest, p interface{}) *admissionResponse {
+	requestLogger(req).Error("panic serving admission request", "path", r.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	return errorResponse(http.StatusInternalServerError, fmt.Errorf("internal error evaluating the request"))
+}
+
+// deadline returns how long a request may be evaluated for: a tenth less
+// than the webhook's timeoutSeconds, or than the timeout the API server
+// sends as a query parameter when that is shorter, so the answer arrives
+// before the API server gives up on the call.
+func (ws *WebHookServer) deadline(r *http.Request) time.Duration {
+	timeout := ws.timeout
+	if d, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && d > 0 && (timeout <= 0 || d < timeout) {
+		timeout = d
 	}
-	admReview := v1beta1.AdmissionReview{}
-	if admResponse != nil {
-		admReview.Response = admResponse
-		if ar.Request != nil {
-			admReview.Response.UID = ar.Request.UID
+	return timeout - timeout/10
+}
+
+// timeoutResponse answers a request whose evaluation missed its deadline.
+func timeoutResponse(deadline time.Duration, failOpen bool) *admissionResponse {
+	err := fmt.Errorf("evaluation did not finish within %s", deadline)
+	if !failOpen {
+		return errorResponse(http.StatusGatewayTimeout, err)
+	}
+	return &admissionResponse{
+		AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed:          true,
+			AuditAnnotations: map[string]string{"evaluation-timeout": err.Error()},
+		},
+		Warnings: []string{"admitted without policy checks: " + err.Error()},
+	}
+}
+
+// requestError is a request serve refuses to evaluate.
+type requestError struct {
+	code int
+	err  error
+}
+
+// readReview checks the HTTP request and decodes the AdmissionReview it
+// carries. The apiVersion is returned whenever it could be read.
+func (ws *WebHookServer) readReview(r *http.Request) (*v1beta1.AdmissionReview, string, *requestError) {
+	if ws.requireClientCert && !verifiedClient(r) {
+		return nil, "", &requestError{http.StatusUnauthorized, fmt.Errorf("a verified client certificate is required")}
+	}
+	maxBytes := ws.maxRequestBytes
+	if r.Method != http.MethodPost {
+		return nil, "", &requestError{http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed, use POST", r.Method)}
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return nil, "", &requestError{http.StatusUnsupportedMediaType, fmt.Errorf("content type %q is not supported, use application/json", r.Header.Get("Content-Type"))}
+	}
+	tooLarge := &requestError{http.StatusRequestEntityTooLarge, fmt.Errorf("AdmissionReview is larger than %d bytes", maxBytes)}
+	if maxBytes > 0 && r.ContentLength > maxBytes {
+		return nil, "", tooLarge
+	}
+	var body []byte
+	if r.Body != nil {
+		var in io.Reader = r.Body
+		if maxBytes > 0 {
+			in = io.LimitReader(r.Body, maxBytes+1)
+		}
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, "", &requestError{http.StatusBadRequest, fmt.Errorf("reading body: %v", err)}
+		}
+		if maxBytes > 0 && int64(len(data)) > maxBytes {
+			return nil, "", tooLarge
 		}
+		body = data
 	}
-	resp, err := json.Marshal(admReview)
+	if len(body) == 0 {
+		return nil, "", &requestError{http.StatusBadRequest, fmt.Errorf("empty body")}
+	}
+	ar, apiVersion, err := decodeReview(body)
+	if err != nil {
+		return nil, apiVersion, &requestError{http.StatusBadRequest, fmt.Errorf("invalid AdmissionReview: %v", err)}
+	}
+	if ar.Request == nil {
+		return nil, apiVersion, &requestError{http.StatusBadRequest, fmt.Errorf("AdmissionReview has no request")}
+	}
+	return ar, apiVersion, nil
+}
+
+// errorResponse refuses a request that could not be evaluated.
+func errorResponse(code int, err error) *admissionResponse {
+	return &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  statusReason(code),
+			Code:    int32(code),
+		},
+	}}
+}
+
+func statusReason(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusBadRequest:
+		return metav1.StatusReasonBadRequest
+	case http.StatusUnauthorized:
+		return metav1.StatusReasonUnauthorized
+	case http.StatusNotFound:
+		return metav1.StatusReasonNotFound
+	case http.StatusMethodNotAllowed:
+		return metav1.StatusReasonMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return metav1.StatusReasonRequestEntityTooLarge
+	case http.StatusUnsupportedMediaType:
+		return metav1.StatusReasonUnsupportedMediaType
+	case http.StatusGatewayTimeout:
+		return metav1.StatusReasonTimeout
+	}
+	return metav1.StatusReasonInternalError
+}
+
+// finish records resp and writes it with the HTTP status code. Decisions,
+// including objects mutate and validate could not decode, are sent with 200
+// so the API server reads them. Requests serve refused to evaluate are sent
+// with the code of their status.
+func (ws *WebHookServer) finish(w http.ResponseWriter, r *http.Request, code int, start time.Time, apiVersion, revision string, req *v1beta1.AdmissionRequest, resp *admissionResponse) {
+	if req != nil {
+		resp.UID = req.UID
+	}
+	rlog := requestLogger(req).With("path", r.URL.Path, "apiVersion", apiVersion, "policyRevision", revision)
+	observeRequest(r.URL.Path, req, resp, start)
+	rlog.Info("admission decision", "decision", responseOutcome(resp), "latency", time.Since(start))
+	// dry runs are evaluated in full but leave no audit trail
+	if req == nil || !isDryRun(req) {
+		ws.record(newAuditRecord(r.URL.Path, revision, req, resp, start))
+	}
+
+	data, err := encodeReview(apiVersion, resp)
 	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
+		rlog.Error("can't encode response", "error", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodPost)
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write(data); err != nil {
+		rlog.Error("can't write response", "error", err)
+	}
+}
+
+// requestLogger returns a logger carrying the fields identifying req.
+func requestLogger(req *v1beta1.AdmissionRequest) *logger {
+	if req == nil {
+		return log
+	}
+	return log.With("uid", req.UID, "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "operation", req.Operation)
+}
+
+func (ws *WebHookServer) record(rec *auditRecord) {
+	if ws.audit == nil {
+		// without an audit log, audit mode violations would go unnoticed
+		for _, v := range rec.Violations {
+			if v.Mode == ModeAudit {
+				log.Info("audit mode violation", "uid", rec.UID, "kind", rec.Kind, "namespace", rec.Namespace,
+					"name", rec.Name, "rule", v.Rule, "message", v.Message)
+			}
+		}
+		return
 	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	if err := ws.audit.write(rec); err != nil {
+		log.Error("can't write audit record", "uid", rec.UID, "error", err)
 	}
 }
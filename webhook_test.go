@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files in testdata")
+
+// golden is what a fixture is compared against: the HTTP status and body
+// serve answered with, the decoded patch, the request object with the patch
+// applied and the audit records written.
+type golden struct {
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+	Patch    json.RawMessage `json:"patch,omitempty"`
+	Patched  json.RawMessage `json:"patched,omitempty"`
+	Audit    []*auditRecord  `json:"audit"`
+}
+
+type fixtureRequest struct {
+	Method          string `json:"method"`
+	Path            string `json:"path"`
+	ContentType     string `json:"contentType"`
+	MaxRequestBytes int64  `json:"maxRequestBytes"`
+}
+
+// TestWebHookServer drives serve with every fixture under testdata/mutate
+// and testdata/validate. A fixture is a directory holding review.json, the
+// request body, and golden.json, the expected result. The policy is the
+// fixture's policy.yaml if it has one, testdata/policy.yaml otherwise. An
+// http.json file changes the method, path or content type of the request, or
+// the size limit of the server.
+// Run with -update to regenerate golden.json.
+func TestWebHookServer(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	for _, endpoint := range []string{"mutate", "validate"} {
+		dirs, err := filepath.Glob(filepath.Join("testdata", endpoint, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dirs) == 0 {
+			t.Fatalf("no fixtures in testdata/%s", endpoint)
+		}
+		for _, dir := range dirs {
+			dir := dir
+			t.Run(endpoint+"/"+filepath.Base(dir), func(t *testing.T) {
+				testGolden(t, "/"+endpoint, dir)
+			})
+		}
+	}
+}
+
+func testGolden(t *testing.T, endpoint, dir string) {
+	body, err := ioutil.ReadFile(filepath.Join(dir, "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if _, err := os.Stat(policyFile); err != nil {
+		policyFile = filepath.Join("testdata", "policy.yaml")
+	}
+	policies, err := newPolicyStore(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// http.json optionally overrides how the review is sent
+	sent := fixtureRequest{Method: http.MethodPost, Path: endpoint, ContentType: "application/json"}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "http.json")); err == nil {
+		if err := json.Unmarshal(data, &sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var audit bytes.Buffer
+	ws := &WebHookServer{policies: policies, audit: &auditLog{out: nopCloser{&audit}}, maxRequestBytes: sent.MaxRequestBytes}
+	r := httptest.NewRequest(sent.Method, sent.Path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", sent.ContentType)
+	w := httptest.NewRecorder()
+	ws.serve(w, r)
+
+	got := golden{Status: w.Code, Audit: []*auditRecord{}}
+	if json.Valid(w.Body.Bytes()) {
+		got.Response = w.Body.Bytes()
+	} else {
+		got.Response, _ = json.Marshal(w.Body.String())
+	}
+	review := admissionReviewResponse{}
+	if json.Unmarshal(w.Body.Bytes(), &review) == nil && review.Response != nil && len(review.Response.Patch) > 0 {
+		ar, _, err := decodeReview(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Patch = review.Response.Patch
+		patched, err := applyPatch(ar.Request.Object.Raw, review.Response.Patch)
+		if err != nil {
+			t.Fatalf("applying patch %s: %v", review.Response.Patch, err)
+		}
+		// the patch keeps the key order of the object, golden files sort it
+		var obj interface{}
+		if err := json.Unmarshal(patched, &obj); err != nil {
+			t.Fatal(err)
+		}
+		if got.Patched, err = json.Marshal(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, line := range bytes.Split(bytes.TrimSpace(audit.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		rec := &auditRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			t.Fatalf("invalid audit record %s: %v", line, err)
+		}
+		// the only fields that change from run to run
+		rec.Time, rec.LatencyMs = time.Time{}, 0
+		got.Audit = append(got.Audit, rec)
+	}
+
+	data, err := marshalGolden(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenFile := filepath.Join(dir, "golden.json")
+	if *update {
+		if err := ioutil.WriteFile(goldenFile, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("%s differs, run with -update to accept\ngot:\n%s\nwant:\n%s", goldenFile, data, want)
+	}
+}
+
+func marshalGolden(g golden) ([]byte, error) {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func TestServeRecoversFromPanic(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "validate", "pod-allowed", "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	// without a policy store the evaluation panics
+	(&WebHookServer{}).serve(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	review := admissionReviewResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body.Bytes(), err)
+	}
+	resp := review.Response
+	if resp == nil || resp.Allowed || resp.Result == nil || resp.Result.Code != http.StatusInternalServerError || resp.UID != "v-1" {
+		t.Errorf("unexpected response %s", w.Body.Bytes())
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		query   string
+		want    time.Duration
+	}{
+		{name: "no deadline"},
+		{name: "timeoutSeconds", timeout: 10 * time.Second, want: 9 * time.Second},
+		{name: "shorter query timeout", timeout: 10 * time.Second, query: "?timeout=5s", want: 4500 * time.Millisecond},
+		{name: "longer query timeout", timeout: 10 * time.Second, query: "?timeout=30s", want: 9 * time.Second},
+		{name: "query timeout only", query: "?timeout=2s", want: 1800 * time.Millisecond},
+		{name: "invalid query timeout", timeout: 10 * time.Second, query: "?timeout=soon", want: 9 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &WebHookServer{timeout: tt.timeout}
+			r := httptest.NewRequest(http.MethodPost, "/validate"+tt.query, nil)
+			if got := ws.deadline(r); got != tt.want {
+				t.Errorf("deadline() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutResponse(t *testing.T) {
+	open := timeoutResponse(time.Second, true)
+	if !open.Allowed || len(open.Warnings) != 1 || responseOutcome(open) != outcomeAllowed {
+		t.Errorf("fail open response = %+v, want allowed with a warning", open)
+	}
+	closed := timeoutResponse(time.Second, false)
+	if closed.Allowed || closed.Result == nil || closed.Result.Code != http.StatusGatewayTimeout || responseOutcome(closed) != outcomeError {
+		t.Errorf("fail closed response = %+v, want a gateway timeout error", closed)
+	}
+}
+
+func TestServeDeadlineExceeded(t *testing.T) {
+	setLog(t, ioutil.Discard, levelError)
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "validate", "pod-allowed", "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := newPolicyStore(filepath.Join("testdata", "policy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failOpen := range []bool{true, false} {
+		var audit bytes.Buffer
+		release := make(chan struct{})
+		ws := &WebHookServer{
+			policies: policies,
+			audit:    &auditLog{out: nopCloser{&audit}},
+			failOpen: failOpen,
+			evaluate: func(*v1beta1.AdmissionReview, *Policy) *admissionResponse {
+				<-release
+				return &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{Allowed: true}}
+			},
+		}
+		r := httptest.NewRequest(http.MethodPost, "/validate?timeout=50ms", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ws.serve(w, r)
+		close(release)
+
+		review := admissionReviewResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+			t.Fatalf("failOpen %v: invalid response %s: %v", failOpen, w.Body.Bytes(), err)
+		}
+		resp := review.Response
+		if w.Code != http.StatusOK || resp == nil || resp.UID != "v-1" {
+			t.Fatalf("failOpen %v: status %d, response %s", failOpen, w.Code, w.Body.Bytes())
+		}
+		rec := auditRecord{}
+		if err := json.Unmarshal(bytes.TrimSpace(audit.Bytes()), &rec); err != nil {
+			t.Fatalf("failOpen %v: invalid audit record %s: %v", failOpen, audit.Bytes(), err)
+		}
+		if failOpen {
+			if !resp.Allowed || len(resp.Warnings) != 1 || resp.AuditAnnotations["evaluation-timeout"] == "" {
+				t.Errorf("failOpen %v: response %s, want allowed with a warning", failOpen, w.Body.Bytes())
+			}
+			if rec.Decision != outcomeAllowed || len(rec.Warnings) != 1 {
+				t.Errorf("failOpen %v: audit decision %s with warnings %q, want allowed with a warning", failOpen, rec.Decision, rec.Warnings)
+			}
+			continue
+		}
+		if resp.Allowed || resp.Result == nil || resp.Result.Code != http.StatusGatewayTimeout {
+			t.Errorf("failOpen %v: response %s, want a gateway timeout", failOpen, w.Body.Bytes())
+		}
+		if rec.Decision != outcomeError {
+			t.Errorf("failOpen %v: audit decision %s, want %s", failOpen, rec.Decision, outcomeError)
+		}
+	}
+}
+
+func TestReqMutation(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		defaults map[string]string
+		want     bool
+	}{
+		{name: "no labels", defaults: map[string]string{"team": "ops"}, want: true},
+		{name: "missing key", labels: map[string]string{"app": "web"}, defaults: map[string]string{"team": "ops"}, want: true},
+		{name: "other value", labels: map[string]string{"team": "dev"}, defaults: map[string]string{"team": "ops"}},
+		{name: "empty value", labels: map[string]string{"team": ""}, defaults: map[string]string{"team": "ops"}},
+		{name: "one of two missing", labels: map[string]string{"team": "ops"}, defaults: map[string]string{"team": "ops", "tier": "web"}, want: true},
+		{name: "no defaults", labels: map[string]string{"team": "ops"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reqMutation(tt.labels, tt.defaults); got != tt.want {
+				t.Errorf("reqMutation(%v, %v) = %v, want %v", tt.labels, tt.defaults, got, tt.want)
+			}
+		})
+	}
+}
+
+// setLog points the process wide logger at out, as text, until the test ends.
+func setLog(t *testing.T, out io.Writer, level logLevel) {
+	s := log.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	savedOut, savedJSON, savedLevel := s.out, s.json, s.minLevel
+	s.out, s.json, s.minLevel = out, false, level
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.out, s.json, s.minLevel = savedOut, savedJSON, savedLevel
+	})
+}
+
+func TestRecordWithoutAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	setLog(t, &out, levelInfo)
+	ws := &WebHookServer{}
+	ws.record(&auditRecord{UID: "u-1", Kind: "Pod", Violations: []violation{
+		{Rule: "audited", Mode: ModeAudit, Message: "missing label team"},
+		{Rule: "enforced", Mode: ModeEnforce, Message: "missing label app"},
+	}})
+	got := out.String()
+	if !strings.Contains(got, "audit mode violation") || !strings.Contains(got, "rule=audited") {
+		t.Errorf("audit mode violation not logged: %q", got)
+	}
+	if strings.Contains(got, "enforced") {
+		t.Errorf("enforced violation logged: %q", got)
+	}
+}